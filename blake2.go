@@ -4,10 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"io"
-	"os"
-
-	"github.com/codahale/blake2"
 )
 
 func (foot *Footer) FillHashes(cfg *CombinerConfig) error {
@@ -15,36 +11,85 @@ func (foot *Footer) FillHashes(cfg *CombinerConfig) error {
 	copy(foot.MagicFooterNumber1[:], MAGIC1[:])
 	copy(foot.MagicFooterNumber2[:], MAGIC2[:])
 
+	alg := cfg.HashAlgorithm
+	if !alg.valid() {
+		return fmt.Errorf("unknown hash algorithm %s", alg)
+	}
+	foot.HashAlgorithm = alg
+
 	var hash []byte
 	var sz int64
 	var err error
 
-	hash, sz, err = Blake2HashFile(cfg.ExecutablePath)
+	hash, sz, err = HashFile(cfg.ExecutablePath, alg)
 	if err != nil {
 		return err
 	}
-	copy(foot.ExecutableBlake2Checksum[:], hash)
+	foot.ExecutableBlake2Checksum = padChecksum(hash)
 	foot.ExecutableLengthBytes = sz
 
-	hash, sz, err = Blake2HashFile(cfg.ZipfilePath)
+	hash, sz, err = HashFile(cfg.ZipfilePath, alg)
 	if err != nil {
 		return err
 	}
-	copy(foot.ZipfileBlake2Checksum[:], hash)
+	foot.ZipfileBlake2Checksum = padChecksum(hash)
 	foot.ZipfileLengthBytes = sz
 
-	// fill FooterChecksum
-	foot.FooterLengthBytes = 256
+	// the payloads follow the zip
+	foot.Payloads = nil
+	off := foot.ExecutableLengthBytes + foot.ZipfileLengthBytes
+	for _, np := range cfg.Payloads {
+		hash, sz, err = HashFile(np.Path, alg)
+		if err != nil {
+			return err
+		}
+		pl := Payload{Name: np.Name, Offset: off, Length: sz, Blake2Checksum: padChecksum(hash)}
+		foot.Payloads = append(foot.Payloads, pl)
+		off += sz
+	}
 
-	hash = foot.GetFooterChecksum()
+	// only write a v2 footer if there is metadata for it to carry
+	foot.Metadata, err = footerMetadata(cfg.Metadata, foot.Payloads)
+	if err != nil {
+		return err
+	}
+	if cfg.SigningKeyPath != "" {
+		key, err := ReadSigningKey(cfg.SigningKeyPath)
+		if err != nil {
+			return err
+		}
+		err = foot.sign(key)
+		if err != nil {
+			return err
+		}
+	}
+	foot.MetadataLengthBytes = 0
+	if foot.Metadata != nil {
+		region, err := encodeMetadata(foot.Metadata, alg)
+		if err != nil {
+			return err
+		}
+		copy(foot.MagicFooterNumber1[:], MAGIC1_V2[:])
+		foot.MetadataLengthBytes = int64(len(region))
+	}
+
+	// fill FooterChecksum
+	foot.FooterLengthBytes = LIBZIPFS_FOOTER_LEN + foot.MetadataLengthBytes
 
-	copy(foot.FooterBlake2Checksum[:], hash)
+	foot.FooterBlake2Checksum = padChecksum(foot.GetFooterChecksum())
 	VPrintf("debug: foot.FooterBlake2Checksum = '%x'\n", foot.FooterBlake2Checksum)
 
 	return nil
 }
 
+// GetFooterChecksum gives the checksum of the FooterTrailer, by its
+// HashAlgorithm; nil if that is unknown.
 func (foot *Footer) GetFooterChecksum() []byte {
+	h := foot.HashAlgorithm.New()
+	if h == nil {
+		return nil
+	}
+
 	// preserve any checksum, so we can zero it for the hashing
 	var footerCheck [64]byte
 	copy(footerCheck[:], foot.FooterBlake2Checksum[:])
@@ -53,7 +98,6 @@ func (foot *Footer) GetFooterChecksum() []byte {
 		foot.FooterBlake2Checksum[i] = 0
 	}
 
-	h := blake2.New(nil)
 	h.Write(foot.ToBytes())
 
 	// restore any checksum already there
@@ -62,46 +106,33 @@ func (foot *Footer) GetFooterChecksum() []byte {
 	return []byte(h.Sum(nil))
 }
 
+// Blake2HashFile is HashFile with HashBLAKE2b.
 func Blake2HashFile(path string) (hash []byte, length int64, err error) {
-	if !FileExists(path) {
-		return nil, 0, fmt.Errorf("no such file: '%s'", path)
-	}
-
-	of, err := os.Open(path)
-	if err != nil {
-		return nil, 0, fmt.Errorf("Blake2HashFile() error during opening file '%s': '%s'", path, err)
-	}
-	defer of.Close()
-
-	h := blake2.New(nil)
-	length, err = io.Copy(h, of)
-	if err != nil {
-		return nil, 0, fmt.Errorf("Blake2HashFile() error during reading from file '%s': '%s'", path, err)
-	}
-	hash = h.Sum(nil)
-	VPrintf("hash = '%x' for file '%s'\n", hash, path)
-	return hash, length, nil
+	return HashFile(path, HashBLAKE2b)
 }
 
+// ToBytes gives the FooterTrailer of f; see MetadataBytes for the
+// rest of a v2 footer.
 func (f *Footer) ToBytes() []byte {
 	// Create a struct and write it.
 	buf := &bytes.Buffer{}
-	err := binary.Write(buf, binary.BigEndian, f)
+	err := binary.Write(buf, binary.BigEndian, &f.FooterTrailer)
 	if err != nil {
 		panic(err)
 	}
-	VPrintf("ToBytes() debug: wrote %#v to string of bytes '%x'\n", *f, string(buf.Bytes()))
+	VPrintf("ToBytes() debug: wrote %#v to string of bytes '%x'\n", f.FooterTrailer, string(buf.Bytes()))
 	return buf.Bytes()
 }
 
+// FromBytes reads the FooterTrailer in by, leaving f with no Metadata.
 func (f *Footer) FromBytes(by []byte) {
 	// Read into an empty struct.
 	*f = Footer{}
-	err := binary.Read(bytes.NewBuffer(by), binary.BigEndian, f)
+	err := binary.Read(bytes.NewBuffer(by), binary.BigEndian, &f.FooterTrailer)
 	if err != nil {
 		panic(err)
 	}
-	VPrintf("FromBytes() debug: read f = '%#v' from bytes '%x'\n", *f, string(by))
+	VPrintf("FromBytes() debug: read f = '%#v' from bytes '%x'\n", f.FooterTrailer, string(by))
 }
 
 func compareByteSlices(a, b []byte, sz int) (diffpos int, err error) {
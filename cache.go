@@ -0,0 +1,138 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"container/list"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultCacheFileBytes is the largest entry MountOptions.CacheBytes
+// keeps, unless CacheFileBytes says otherwise.
+const DefaultCacheFileBytes = 1 << 20
+
+// contentCache keeps the decompressed contents of recently opened
+// entries, up to maxBytes in all, dropping the least recently used
+// first.
+type contentCache struct {
+	mut          sync.Mutex
+	maxBytes     int64
+	maxFileBytes int64
+	bytes        int64
+	lru          *list.List // of *cachedEntry, most recently used at the front
+	entries      map[*zip.File]*list.Element
+	hits, misses int64
+}
+
+type cachedEntry struct {
+	f    *zip.File
+	data []byte
+}
+
+func newContentCache(maxBytes, maxFileBytes int64) *contentCache {
+	if maxFileBytes <= 0 {
+		maxFileBytes = DefaultCacheFileBytes
+	}
+	if maxFileBytes > maxBytes {
+		maxFileBytes = maxBytes
+	}
+	return &contentCache{
+		maxBytes:     maxBytes,
+		maxFileBytes: maxFileBytes,
+		lru:          list.New(),
+		entries:      make(map[*zip.File]*list.Element),
+	}
+}
+
+func (c *contentCache) get(f *zip.File) ([]byte, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	el, ok := c.entries[f]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*cachedEntry).data, true
+}
+
+func (c *contentCache) put(f *zip.File, data []byte) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if _, ok := c.entries[f]; ok {
+		return // a concurrent open got there first
+	}
+	c.entries[f] = c.lru.PushFront(&cachedEntry{f: f, data: data})
+	c.bytes += int64(len(data))
+	for c.bytes > c.maxBytes {
+		oldest := c.lru.Back()
+		e := oldest.Value.(*cachedEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, e.f)
+		c.bytes -= int64(len(e.data))
+	}
+}
+
+// drop forgets the contents of files, which are no longer served.
+func (c *contentCache) drop(files []*zip.File) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, f := range files {
+		el, ok := c.entries[f]
+		if !ok {
+			continue
+		}
+		c.lru.Remove(el)
+		delete(c.entries, f)
+		c.bytes -= int64(len(el.Value.(*cachedEntry).data))
+	}
+}
+
+// contentCache returns the cache, or nil if MountOptions.CacheBytes
+// doesn't ask for one.
+func (fsys *FS) contentCache() *contentCache {
+	if fsys.opts.CacheBytes <= 0 {
+		return nil
+	}
+	fsys.mut.Lock()
+	defer fsys.mut.Unlock()
+	if fsys.cache == nil {
+		fsys.cache = newContentCache(fsys.opts.CacheBytes, fsys.opts.CacheFileBytes)
+	}
+	return fsys.cache
+}
+
+// cacheable reports whether opens of f should go through the cache.
+// Stored entries are read from the zipfile as they are, which is as
+// fast; encrypted ones are left out so that every open has to give
+// the password.
+func (fsys *FS) cacheable(f *zip.File) bool {
+	c := fsys.contentCache()
+	return c != nil && !isStored(f) && !isEncrypted(f) &&
+		int64(f.UncompressedSize64) <= c.maxFileBytes
+}
+
+// cachedContents returns all of f, decompressed, from the cache if
+// it is there, and otherwise decompresses and caches it.
+func (fsys *FS) cachedContents(ctx context.Context, f *zip.File) ([]byte, error) {
+	c := fsys.contentCache()
+	if data, ok := c.get(f); ok {
+		return data, nil
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// read to EOF, so that archive/zip checks the CRC.
+	buf := bytes.NewBuffer(make([]byte, 0, f.UncompressedSize64))
+	if _, err := buf.ReadFrom(&ctxReader{ctx, r}); err != nil {
+		return nil, err
+	}
+	c.put(f, buf.Bytes())
+	VPrintf("cached '%s', %d bytes\n", f.Name, buf.Len())
+	return buf.Bytes(), nil
+}
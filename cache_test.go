@@ -0,0 +1,71 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"testing"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+func Test023DecompressedContentsAreCached(t *testing.T) {
+
+	cv.Convey("with CacheBytes set, small deflated files should be decompressed once, served at any offset, and evicted least recently used first", t, func() {
+		var zbuf bytes.Buffer
+		zw := zip.NewWriter(&zbuf)
+		contents := map[string][]byte{}
+		for i, size := range []int{10 << 10, 10 << 10, 10 << 10, 40 << 10} {
+			name := fmt.Sprintf("f%d", i)
+			contents[name] = testPayload(int64(i), size)
+			w, err := zw.Create(name)
+			panicOn(err)
+			w.Write(contents[name])
+		}
+		zw.Close()
+		fsys := testFS(zbuf.Bytes(), MountOptions{CacheBytes: 25 << 10, CacheFileBytes: 16 << 10})
+
+		ctx := context.Background()
+		readAt := func(name string, off int64) []byte {
+			node, err := lookupPath(fsys, name)
+			panicOn(err)
+			h, err := node.(*File).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+			panicOn(err)
+			defer h.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{})
+			resp := &fuse.ReadResponse{}
+			panicOn(h.(*FileHandle).Read(ctx, &fuse.ReadRequest{Offset: off, Size: 1000}, resp))
+			return resp.Data
+		}
+		cached := func(name string) bool {
+			_, ok := fsys.cache.entries[lookupFile(fsys, name)]
+			return ok
+		}
+
+		cv.So(readAt("f0", 5000), cv.ShouldResemble, contents["f0"][5000:6000])
+		cv.So(readAt("f1", 9000), cv.ShouldResemble, contents["f1"][9000:10000])
+		cv.So(readAt("f0", 0), cv.ShouldResemble, contents["f0"][:1000])
+		cv.So(fsys.cache.hits, cv.ShouldEqual, 1)
+		cv.So(fsys.cache.misses, cv.ShouldEqual, 2)
+
+		// f2 doesn't fit alongside f0 and f1; f1 was used longest ago.
+		cv.So(readAt("f2", 100), cv.ShouldResemble, contents["f2"][100:1100])
+		cv.So(cached("f0"), cv.ShouldBeTrue)
+		cv.So(cached("f1"), cv.ShouldBeFalse)
+		cv.So(cached("f2"), cv.ShouldBeTrue)
+		cv.So(fsys.cache.bytes, cv.ShouldEqual, 20<<10)
+
+		// f3 is over CacheFileBytes, so it is served without the cache.
+		cv.So(readAt("f3", 30000), cv.ShouldResemble, contents["f3"][30000:31000])
+		cv.So(cached("f3"), cv.ShouldBeFalse)
+		cv.So(fsys.cache.misses, cv.ShouldEqual, 3)
+	})
+}
+
+// lookupFile returns the zip entry served at the path names.
+func lookupFile(fsys *FS, names ...string) *zip.File {
+	node, err := lookupPath(fsys, names...)
+	panicOn(err)
+	return node.(*File).file
+}
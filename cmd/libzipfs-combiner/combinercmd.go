@@ -36,6 +36,15 @@ func main() {
 		log.Fatalf("%s command line flag error: '%s'", progName, err)
 	}
 
+	if cfg.GenerateKeyPath != "" {
+		var pub []byte
+		pub, err = lzf.GenerateSigningKey(cfg.GenerateKeyPath)
+		panicOn(err)
+		fmt.Printf("wrote private key to '%s' and public key to '%s.pub'. The public key is:\n%x\n",
+			cfg.GenerateKeyPath, cfg.GenerateKeyPath, pub)
+		return
+	}
+
 	if cfg.Split {
 		_, err = lzf.DoSplitOutExeAndZip(cfg)
 	} else {
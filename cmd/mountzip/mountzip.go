@@ -1,46 +1,234 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/glycerine/libzipfs"
 )
 
 var progName string = path.Base(os.Args[0])
 
+// zipList collects repeated -zip flags.
+type zipList []string
+
+func (z *zipList) String() string {
+	return strings.Join(*z, ",")
+}
+
+func (z *zipList) Set(s string) error {
+	*z = append(*z, s)
+	return nil
+}
+
 type MntzipConfig struct {
-	ZipfilePath string
-	MountPath   string
+	ZipfilePaths zipList
+	MountPath    string
+	Symlinks     string
+	Subdir       string
+	Payload      string
+	Quarantine   string
+	IgnoreCase   bool
+	NFC          bool
+
+	Uid         uint
+	Gid         uint
+	FileMode    string
+	DirMode     string
+	FileMask    string
+	DirMask     string
+	StripSetuid bool
+
+	Writable   bool
+	OverlayDir string
+
+	Watch bool
+
+	PasswordFile   string
+	AllowZipCrypto bool
+
+	EntryTTL  time.Duration
+	AttrTTL   time.Duration
+	KeepCache bool
+
+	CacheMB     int64
+	CacheFileKB int64
+
+	DiskCache    bool
+	DiskCacheDir string
+
+	TrustKeyFiles    zipList
+	RequireSignature bool
+	Verify           bool
+
+	// read from TrustKeyFiles by ValidateConfig
+	trustedKeys []ed25519.PublicKey
 }
 
 // call DefineFlags before myflags.Parse()
 func (c *MntzipConfig) DefineFlags(fs *flag.FlagSet) {
-	fs.StringVar(&c.ZipfilePath, "zip", "", "path to the Zip file (or combo exe+Zip+footer file) to mount")
+	fs.Var(&c.ZipfilePaths, "zip", "path to the Zip file (or combo exe+Zip+footer file) to mount. Repeat to mount several as one tree; earlier ones take priority")
 	fs.StringVar(&c.MountPath, "mnt", "", "directory to fuse-mount the Zip file on")
+	fs.StringVar(&c.Subdir, "subdir", "", "mount only this directory of the Zip file")
+	fs.StringVar(&c.Payload, "payload", "", "of a combo file, mount the payload with this name instead of the Zip file")
+	fs.BoolVar(&c.IgnoreCase, "ignore-case", false, "find files whatever the case of the name asked for")
+	fs.BoolVar(&c.NFC, "nfc", false, "find files whatever the Unicode normalization of the name asked for")
+	fs.StringVar(&c.Quarantine, "quarantine", "", "serve entries with unsafe names like '../x' in this top-level directory, instead of leaving them out")
+	fs.StringVar(&c.Symlinks, "symlinks", "reject", "what to do with symlinks pointing outside the Zip file: reject, allow, or resolve (inside the mount)")
+	fs.UintVar(&c.Uid, "uid", 0, "uid to own all files and directories")
+	fs.UintVar(&c.Gid, "gid", 0, "gid to own all files and directories")
+	fs.StringVar(&c.FileMode, "fmode", "", "octal permissions to give all files, instead of those in the Zip file")
+	fs.StringVar(&c.DirMode, "dmode", "", "octal permissions to give all directories, instead of those in the Zip file")
+	fs.StringVar(&c.FileMask, "fmask", "", "octal permission bits to clear from all files")
+	fs.StringVar(&c.DirMask, "dmask", "", "octal permission bits to clear from all directories")
+	fs.BoolVar(&c.StripSetuid, "nosuid", false, "clear setuid and setgid bits")
+	fs.BoolVar(&c.Writable, "writable", false, "allow writes, keeping changes in a temporary overlay directory that is removed at exit")
+	fs.StringVar(&c.OverlayDir, "overlay", "", "allow writes, keeping changes in this directory (which must exist)")
+	fs.BoolVar(&c.Watch, "watch", false, "serve the new contents whenever a Zip file is rewritten")
+	fs.StringVar(&c.PasswordFile, "password-file", "", "file holding the password for encrypted entries")
+	fs.BoolVar(&c.AllowZipCrypto, "allow-zipcrypto", false, "also decrypt entries using the weak PKWARE ZipCrypto, not just WinZip AES")
+	fs.DurationVar(&c.EntryTTL, "entry-ttl", 0, "how long the kernel may cache name lookups (0 => 1m)")
+	fs.DurationVar(&c.AttrTTL, "attr-ttl", 0, "how long the kernel may cache file attributes (0 => 1m)")
+	fs.BoolVar(&c.KeepCache, "keep-cache", false, "let the kernel keep file contents cached between opens")
+	fs.Int64Var(&c.CacheMB, "cache-mb", 0, "keep up to this many MiB of decompressed file contents in memory (0 => no cache)")
+	fs.Int64Var(&c.CacheFileKB, "cache-file-kb", 0, "largest file, in KiB, to keep in the -cache-mb cache (0 => 1024)")
+	fs.BoolVar(&c.DiskCache, "disk-cache", false, "keep decompressed files of a combo in $XDG_CACHE_HOME/libzipfs, for this and later mounts")
+	fs.StringVar(&c.DiskCacheDir, "disk-cache-dir", "", "keep decompressed files of a combo in this directory, for this and later mounts")
+	fs.BoolVar(&c.RequireSignature, "require-signature", false, "refuse to mount anything but combo files signed by a -trust key")
+	fs.BoolVar(&c.Verify, "verify", false, "check the exe and Zip file of a combo against the checksums in its footer before mounting")
+	fs.Var(&c.TrustKeyFiles, "trust", "path to an Ed25519 public key file (from libzipfs-combiner -genkey) whose signatures to accept; may be repeated")
+}
+
+// parseMode reads an octal mode flag; "" is zero.
+func parseMode(flagName, s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("-%s '%s' is not an octal permission like 0644", flagName, s)
+	}
+	return os.FileMode(m), nil
+}
+
+// applyTo sets the mount options given by the flags on z.
+func (c *MntzipConfig) applyTo(z *libzipfs.FuseZipFs) {
+	z.Subdir = c.Subdir
+	z.QuarantineDir = c.Quarantine
+	if c.IgnoreCase {
+		z.LookupFold |= libzipfs.FoldCase
+	}
+	if c.NFC {
+		z.LookupFold |= libzipfs.FoldUnicode
+	}
+	z.SymlinkPolicy, _ = libzipfs.ParseSymlinkPolicy(c.Symlinks)
+	z.Uid = uint32(c.Uid)
+	z.Gid = uint32(c.Gid)
+	z.FileMode, _ = parseMode("fmode", c.FileMode)
+	z.DirMode, _ = parseMode("dmode", c.DirMode)
+	z.FileMask, _ = parseMode("fmask", c.FileMask)
+	z.DirMask, _ = parseMode("dmask", c.DirMask)
+	z.StripSetuid = c.StripSetuid
+	z.Writable = c.Writable || c.OverlayDir != ""
+	z.OverlayDir = c.OverlayDir
+	z.Watch = c.Watch
+	z.EntryValid = c.EntryTTL
+	z.AttrValid = c.AttrTTL
+	z.KeepCache = c.KeepCache
+	z.CacheBytes = c.CacheMB << 20
+	z.CacheFileBytes = c.CacheFileKB << 10
+	z.DiskCacheDir = c.DiskCacheDir
+	z.RequireSignature = c.RequireSignature
+	z.TrustedKeys = c.trustedKeys
+	z.VerifyChecksums = c.Verify
+	z.AllowZipCrypto = c.AllowZipCrypto
+	if c.PasswordFile != "" {
+		z.PasswordProvider = passwordFromFile(c.PasswordFile)
+	}
+}
+
+// passwordFromFile gives the password in path, less any trailing
+// newline, for every entry. The file is read at each open, so it
+// can be changed while mounted.
+func passwordFromFile(path string) libzipfs.PasswordProvider {
+	return func(entryName string) ([]byte, error) {
+		pw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(pw, "\r\n"), nil
+	}
 }
 
 // call c.ValidateConfig() after myflags.Parse()
 func (c *MntzipConfig) ValidateConfig() error {
-	if c.ZipfilePath == "" {
+	if len(c.ZipfilePaths) == 0 {
 		return fmt.Errorf("-zip flag required and missing")
 	}
 	if c.MountPath == "" {
 		return fmt.Errorf("-mnt file required and missing")
 	}
 
-	if !libzipfs.FileExists(c.ZipfilePath) {
-		return fmt.Errorf("-zip path '%s' not found.", c.ZipfilePath)
+	for _, path := range c.ZipfilePaths {
+		if !libzipfs.FileExists(path) {
+			return fmt.Errorf("-zip path '%s' not found.", path)
+		}
 	}
 
 	if !libzipfs.DirExists(c.MountPath) {
 		return fmt.Errorf("-mnt mount path '%s' not found.", c.MountPath)
 	}
 
+	if _, err := libzipfs.ParseSymlinkPolicy(c.Symlinks); err != nil {
+		return fmt.Errorf("-symlinks: %s", err)
+	}
+
+	if c.PasswordFile != "" && !libzipfs.FileExists(c.PasswordFile) {
+		return fmt.Errorf("-password-file '%s' not found.", c.PasswordFile)
+	}
+
+	if c.OverlayDir != "" && !libzipfs.DirExists(c.OverlayDir) {
+		return fmt.Errorf("-overlay directory '%s' not found.", c.OverlayDir)
+	}
+
+	if c.DiskCache && c.DiskCacheDir == "" {
+		dir, err := libzipfs.DefaultDiskCacheDir()
+		if err != nil {
+			return fmt.Errorf("-disk-cache: %s", err)
+		}
+		c.DiskCacheDir = dir
+	}
+
+	for _, path := range c.TrustKeyFiles {
+		key, err := libzipfs.ReadPublicKey(path)
+		if err != nil {
+			return fmt.Errorf("-trust: %s", err)
+		}
+		c.trustedKeys = append(c.trustedKeys, key)
+	}
+	if c.RequireSignature && len(c.trustedKeys) == 0 {
+		return fmt.Errorf("-require-signature needs at least one -trust key")
+	}
+
+	modes := []struct{ name, val string }{
+		{"fmode", c.FileMode}, {"dmode", c.DirMode}, {"fmask", c.FileMask}, {"dmask", c.DirMask},
+	}
+	for _, m := range modes {
+		if _, err := parseMode(m.name, m.val); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -66,31 +254,44 @@ func main() {
 		log.Fatalf("%s command line flag error: '%s'", progName, err)
 	}
 
-	byteOffsetToZipFileStart := int64(0)
-	bytesAvail := int64(0)
-	footerBytes := int64(0)
+	var layers []libzipfs.ZipLayer
+	for _, path := range cfg.ZipfilePaths {
+		layer := libzipfs.ZipLayer{ZipfilePath: path}
 
-	// detect if this is a combo file
-	_, foot, comb, err := libzipfs.ReadFooter(cfg.ZipfilePath)
-	if err != nil {
-		// assume it is a regular zip file, not a combo file.
-	} else {
-		comb.Close()
-		byteOffsetToZipFileStart = foot.ExecutableLengthBytes
-		bytesAvail = foot.ZipfileLengthBytes
-		footerBytes = foot.FooterLengthBytes
+		// detect if this is a combo file
+		_, _, comb, err := libzipfs.ReadFooter(path)
+		if err != nil {
+			// assume it is a regular zip file, not a combo file.
+			if cfg.Payload != "" {
+				log.Fatalf("%s error: -payload given, but '%s' is not a combo file: '%s'", progName, path, err)
+			}
+		} else {
+			comb.Close()
+			layer, _, err = libzipfs.ComboZipLayer(path, cfg.Payload)
+			if err != nil {
+				log.Fatalf("%s error: '%s'", progName, err)
+			}
+		}
+		layers = append(layers, layer)
 	}
 
-	z := libzipfs.NewFuseZipFs(cfg.ZipfilePath,
-		cfg.MountPath, byteOffsetToZipFileStart, bytesAvail, footerBytes)
+	z := libzipfs.NewUnionFuseZipFs(layers, cfg.MountPath)
+	cfg.applyTo(z)
 
 	err = z.Start()
 	if err != nil {
 		log.Fatalf("%s error calling z.Start() to start serving fuse requests: '%s'", progName, err)
 	}
 
+	for _, u := range z.UnsafeNames() {
+		fmt.Fprintf(os.Stderr, "%s: warning: unsafe entry name %s\n", progName, u)
+	}
+	for _, c := range z.FoldCollisions() {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", progName, c)
+	}
+
 	fmt.Printf("\nZip file '%s' mounted at directory '%s'. [press ctrl-c to exit and unmount]\n",
-		cfg.ZipfilePath, cfg.MountPath)
+		cfg.ZipfilePaths.String(), cfg.MountPath)
 
 	select {
 	case <-ctrl_C_chan:
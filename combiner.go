@@ -12,9 +12,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 )
 
 var MAGIC1 = []byte("\nLibZipFs00\n")
+var MAGIC1_V2 = []byte("\nLibZipFs02\n")
 var MAGIC2 = []byte("\nLibZipFsEnd\n")
 
 const LIBZIPFS_FOOTER_LEN = 256
@@ -23,9 +26,31 @@ const MAGIC_NUM_LEN = 16
 
 type FooterArray [LIBZIPFS_FOOTER_LEN]byte
 
+// Footer describes a combo file: exe, then zip, then the footer.
+//
+// A v00 footer, with MAGIC1, is the FooterTrailer alone. A v2
+// footer, with MAGIC1_V2, puts MetadataLengthBytes of key/value
+// metadata (see encodeMetadata) ahead of the trailer; the combiner
+// only writes one when there is metadata to record.
 type Footer struct {
-	Reserved1          int64
-	MagicFooterNumber1 [MAGIC_NUM_LEN]byte
+	FooterTrailer
+
+	// Metadata is the key/value metadata of a v2 footer; nil for v00.
+	Metadata map[string][]byte
+
+	// Payloads are the named zips that follow the zip, if any; see
+	// NamedPayload.
+	Payloads []Payload
+}
+
+// FooterTrailer is the fixed LIBZIPFS_FOOTER_LEN bytes at the very
+// end of every combo file.
+//
+// The checksums are by HashAlgorithm, whatever their names say.
+type FooterTrailer struct {
+	MetadataLengthBytes int64 // Reserved1 in v00 footers, and always 0 there
+	MagicFooterNumber1  [MAGIC_NUM_LEN - 1]byte
+	HashAlgorithm       HashAlgorithm // the last byte of the magic number, once always 0
 
 	ExecutableLengthBytes int64
 	ZipfileLengthBytes    int64
@@ -38,11 +63,44 @@ type Footer struct {
 	MagicFooterNumber2 [MAGIC_NUM_LEN]byte
 }
 
+// IsV2 reports whether foot is a v2 footer, which can carry metadata.
+func (foot *Footer) IsV2() bool {
+	return bytes.Equal(foot.MagicFooterNumber1[:len(MAGIC1_V2)], MAGIC1_V2)
+}
+
 type CombinerConfig struct {
 	ExecutablePath string
 	ZipfilePath    string
 	OutputPath     string
 	Split          bool
+
+	// AllowUnsafeNames combines zips holding entries whose names
+	// CleanEntryName rejects, such as "../../etc/passwd". Mounts
+	// leave such entries out.
+	AllowUnsafeNames bool
+
+	// Metadata, if any, is recorded in a v2 footer, for
+	// FuseZipFs.Metadata() to fetch at runtime.
+	Metadata map[string][]byte
+
+	// Payloads are further zips to carry after ZipfilePath, each
+	// mountable on its own with MountComboZipNamed.
+	Payloads []NamedPayload
+
+	// ExtractPayload, when splitting, is the payload to write to
+	// ZipfilePath, instead of the zip.
+	ExtractPayload string
+
+	// SigningKeyPath, if set, is a private key file (see
+	// ReadSigningKey) to sign the footer with.
+	SigningKeyPath string
+
+	// HashAlgorithm gives the checksums in the footer.
+	HashAlgorithm HashAlgorithm
+
+	// GenerateKeyPath, if set, is where to write a new key pair
+	// (see GenerateSigningKey), instead of combining or splitting.
+	GenerateKeyPath string
 }
 
 // call DefineFlags before myflags.Parse()
@@ -51,10 +109,67 @@ func (c *CombinerConfig) DefineFlags(fs *flag.FlagSet) {
 	fs.StringVar(&c.ZipfilePath, "zip", "", "path to the zip file to embed")
 	fs.StringVar(&c.OutputPath, "o", "", "path to the combined output file to be written (or split if -split given)")
 	fs.BoolVar(&c.Split, "split", false, "split the output file back apart (instead of combine which is the default)")
+	fs.BoolVar(&c.AllowUnsafeNames, "allow-unsafe-names", false, "combine even if the zip has entries named like '../x' or '/x', which mounts leave out")
+	fs.Var((*metadataFlag)(&c.Metadata), "meta", "key=value metadata to record in the footer; may be repeated")
+	fs.Var((*payloadFlag)(&c.Payloads), "payload", "name=path of a further zip to carry, mountable on its own by name; may be repeated")
+	fs.StringVar(&c.ExtractPayload, "extract", "", "with -split, write the payload with this name to the -zip path, instead of the zip")
+	fs.Var(&c.HashAlgorithm, "hash", "algorithm for the checksums in the footer: blake2b, sha256, sha512 or blake3")
+	fs.StringVar(&c.SigningKeyPath, "sign", "", "path to an Ed25519 private key file to sign the footer with")
+	fs.StringVar(&c.GenerateKeyPath, "genkey", "", "write a new Ed25519 private key to this path, and its public key to this path plus '.pub', then exit")
+}
+
+// payloadFlag collects repeated -payload name=path flags.
+type payloadFlag []NamedPayload
+
+func (p *payloadFlag) String() string {
+	var s []string
+	for _, np := range *p {
+		s = append(s, np.Name+"="+np.Path)
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *payloadFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("'%s' is not of the form name=path", s)
+	}
+	*p = append(*p, NamedPayload{Name: s[:i], Path: s[i+1:]})
+	return nil
+}
+
+// metadataFlag collects repeated -meta key=value flags.
+type metadataFlag map[string][]byte
+
+func (m *metadataFlag) String() string {
+	var kv []string
+	for k, v := range *m {
+		kv = append(kv, k+"="+string(v))
+	}
+	sort.Strings(kv)
+	return strings.Join(kv, ",")
+}
+
+func (m *metadataFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("'%s' is not of the form key=value", s)
+	}
+	if *m == nil {
+		*m = make(map[string][]byte)
+	}
+	(*m)[s[:i]] = []byte(s[i+1:])
+	return nil
 }
 
 // call c.ValidateConfig() after myflags.Parse()
 func (c *CombinerConfig) ValidateConfig() error {
+	if c.GenerateKeyPath != "" {
+		if FileExists(c.GenerateKeyPath) {
+			return fmt.Errorf("-genkey path '%s' already exists but should not", c.GenerateKeyPath)
+		}
+		return nil
+	}
 	if c.ExecutablePath == "" {
 		return fmt.Errorf("-exe flag required and missing")
 	}
@@ -92,6 +207,18 @@ func (c *CombinerConfig) ValidateConfig() error {
 		if FileExists(c.OutputPath) {
 			return fmt.Errorf("-o path '%s' already exists but should not", c.OutputPath)
 		}
+
+		for _, np := range c.Payloads {
+			if !FileExists(np.Path) {
+				return fmt.Errorf("-payload '%s' path '%s' not found", np.Name, np.Path)
+			}
+		}
+		if c.ExtractPayload != "" {
+			return fmt.Errorf("-extract only goes with -split")
+		}
+		if c.SigningKeyPath != "" && !FileExists(c.SigningKeyPath) {
+			return fmt.Errorf("-sign key file '%s' not found", c.SigningKeyPath)
+		}
 	}
 
 	return nil
@@ -111,13 +238,24 @@ func DoCombineExeAndZip(cfg *CombinerConfig) error {
 	}
 	VPrintf("zi = '%#v'", zi)
 
+	zips := []string{cfg.ZipfilePath}
+	for _, np := range cfg.Payloads {
+		zips = append(zips, np.Path)
+	}
+	for _, path := range zips {
+		err = checkZipToCombine(path, cfg.AllowUnsafeNames)
+		if err != nil {
+			return err
+		}
+	}
+
 	// create the footer metadata
 	var foot Footer
 	err = foot.FillHashes(cfg)
 	if err != nil {
 		return fmt.Errorf("DoCombinedExeAndZip() error in FillHashes() for cfg '%#v': '%s'", cfg, err)
 	}
-	footBuf := bytes.NewBuffer(foot.ToBytes())
+	footBuf := bytes.NewBuffer(append(foot.MetadataBytes(), foot.ToBytes()...))
 
 	// sanity check against the stat info
 	if xi.Size() != foot.ExecutableLengthBytes {
@@ -132,7 +270,7 @@ func DoCombineExeAndZip(cfg *CombinerConfig) error {
 	panicOn(err)
 	defer o.Close()
 
-	// write to the output file from exe, zip, then footer:
+	// write to the output file from exe, zip, any payloads, then footer:
 
 	// open exe
 	exeFd, err := os.Open(cfg.ExecutablePath)
@@ -158,6 +296,18 @@ func DoCombineExeAndZip(cfg *CombinerConfig) error {
 		panic("wrong zipSz!")
 	}
 
+	// copy the payloads to o
+	for i, np := range cfg.Payloads {
+		fd, err := os.Open(np.Path)
+		panicOn(err)
+		sz, err := io.Copy(o, fd)
+		fd.Close()
+		panicOn(err)
+		if sz != foot.Payloads[i].Length {
+			panic(fmt.Errorf("wrong size for payload '%s'!", np.Name))
+		}
+	}
+
 	// copy footer to o
 	footSz, err := io.Copy(o, footBuf)
 	panicOn(err)
@@ -173,6 +323,31 @@ func DoCombineExeAndZip(cfg *CombinerConfig) error {
 	return nil
 }
 
+// checkZipToCombine warns about the entries of the zip at path that
+// mounts won't serve, and refuses zips with unsafe names unless
+// allowUnsafeNames.
+func checkZipToCombine(path string, allowUnsafeNames bool) error {
+	unsafe, err := CheckZipNames(path)
+	if err != nil {
+		return fmt.Errorf("DoCombinedExeAndZip() error: could not read zipfile path '%s': '%s'", path, err)
+	}
+	for _, u := range unsafe {
+		fmt.Fprintf(os.Stderr, "%s: warning: zipfile '%s' entry %s\n", progName, path, u)
+	}
+	if len(unsafe) > 0 && !allowUnsafeNames {
+		return fmt.Errorf("DoCombinedExeAndZip() error: zipfile '%s' has %d entries with unsafe names, which mounts would leave out. Use -allow-unsafe-names to combine it anyway.", path, len(unsafe))
+	}
+
+	unservable, err := CheckZipMethods(path)
+	if err != nil {
+		return fmt.Errorf("DoCombinedExeAndZip() error: could not read zipfile path '%s': '%s'", path, err)
+	}
+	for _, u := range unservable {
+		fmt.Fprintf(os.Stderr, "%s: warning: zipfile '%s' entry %s, so mounts won't be able to read it\n", progName, path, u)
+	}
+	return nil
+}
+
 func panicOn(err error) {
 	if err != nil {
 		panic(err)
@@ -187,23 +362,32 @@ func exitOn(err error) {
 }
 
 func (foot *Footer) VerifyExeZipChecksums(cfg *CombinerConfig) (err error) {
-
-	hash, _, err := Blake2HashFile(cfg.ExecutablePath)
+	err = foot.verifyChecksum(cfg.ExecutablePath, foot.ExecutableBlake2Checksum, "executable")
 	if err != nil {
 		return err
 	}
-	_, err = compareByteSlices(foot.ExecutableBlake2Checksum[:], hash, BLAKE2_HASH_LEN)
+	return foot.verifyChecksum(cfg.ZipfilePath, foot.ZipfileBlake2Checksum, "zipfile")
+}
+
+// VerifyExePayloadChecksums is VerifyExeZipChecksums for a split out
+// payload, pl, in place of the zip.
+func (foot *Footer) VerifyExePayloadChecksums(cfg *CombinerConfig, pl *Payload) (err error) {
+	err = foot.verifyChecksum(cfg.ExecutablePath, foot.ExecutableBlake2Checksum, "executable")
 	if err != nil {
-		return fmt.Errorf("executable blake2 checksum mismatch: '%s'", err)
+		return err
 	}
+	return foot.verifyChecksum(cfg.ZipfilePath, pl.Blake2Checksum, fmt.Sprintf("payload '%s'", pl.Name))
+}
 
-	hash, _, err = Blake2HashFile(cfg.ZipfilePath)
+// verifyChecksum checks that the file at path, which holds what, has
+// the checksum want, by the HashAlgorithm of foot.
+func (foot *Footer) verifyChecksum(path string, want [BLAKE2_HASH_LEN]byte, what string) error {
+	hash, _, err := HashFile(path, foot.HashAlgorithm)
 	if err != nil {
 		return err
 	}
-	_, err = compareByteSlices(foot.ZipfileBlake2Checksum[:], hash, BLAKE2_HASH_LEN)
-	if err != nil {
-		return fmt.Errorf("zipfile blake2 checksum mismatch: '%s'", err)
+	if padChecksum(hash) != want {
+		return &ChecksumError{Path: path, Region: what, Algorithm: foot.HashAlgorithm, Want: want[:len(hash)], Got: hash}
 	}
 	return nil
 }
@@ -0,0 +1,334 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/context"
+)
+
+// PasswordProvider returns the password to decrypt the zip entry
+// called entryName with. A nil password, or an error, means there
+// is none, and the entry can't be read.
+//
+// A WinZip AES entry is authenticated when it is opened, before any
+// of it is decrypted, so opening one reads it through twice. A wrong
+// password, or data that has been tampered with, fails the open
+// with EACCES. ZipCrypto has nothing to authenticate with: a wrong
+// password gets past its check 1 time in 256, and then fails the
+// CRC check at the end of the entry.
+type PasswordProvider func(entryName string) ([]byte, error)
+
+// Encrypted entries come in two kinds. WinZip AES marks them with
+// compression method 99, and keeps the real method in an extra
+// field; the data is
+//
+//	salt | password check (2) | AES-CTR ciphertext | HMAC-SHA1 (10)
+//
+// The original PKWARE "ZipCrypto" keeps the method and prefixes the
+// data with a 12 byte encrypted header. ZipCrypto is easily broken,
+// so it is only served if MountOptions.AllowZipCrypto is set.
+
+const (
+	winzipAESMethod   = 99
+	winzipAESExtraID  = 0x9901
+	winzipAESIters    = 1000
+	winzipAESCheckLen = 2
+	winzipAESMACLen   = 10
+
+	zipCryptoHeaderLen = 12
+	dataDescriptorFlag = 0x8
+)
+
+// errBadPassword is what opens of an encrypted entry get without a
+// valid password.
+var errBadPassword = fuse.Errno(syscall.EACCES)
+
+// winzipAES is the 0x9901 extra field of an AES entry.
+type winzipAES struct {
+	version uint16 // 1 => AE-1, which keeps the CRC; 2 => AE-2, which doesn't
+	keyLen  int
+	method  uint16 // the real compression method
+	saltLen int
+}
+
+func parseWinzipAES(extra []byte) (*winzipAES, error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		if id == winzipAESExtraID && size >= 7 && string(extra[2:4]) == "AE" {
+			ae := &winzipAES{
+				version: binary.LittleEndian.Uint16(extra),
+				method:  binary.LittleEndian.Uint16(extra[5:]),
+			}
+			switch extra[4] {
+			case 1:
+				ae.keyLen, ae.saltLen = 16, 8
+			case 2:
+				ae.keyLen, ae.saltLen = 24, 12
+			case 3:
+				ae.keyLen, ae.saltLen = 32, 16
+			default:
+				return nil, fmt.Errorf("unknown WinZip AES strength %d", extra[4])
+			}
+			return ae, nil
+		}
+		extra = extra[size:]
+	}
+	return nil, fmt.Errorf("no WinZip AES extra field")
+}
+
+// winzipCTR is AES in counter mode the way WinZip does it: the
+// counter is little-endian and starts at 1.
+type winzipCTR struct {
+	block cipher.Block
+	ctr   [aes.BlockSize]byte
+	ks    [aes.BlockSize]byte
+	used  int
+}
+
+func newWinzipCTR(block cipher.Block) *winzipCTR {
+	return &winzipCTR{block: block, used: aes.BlockSize}
+}
+
+func (c *winzipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			for j := range c.ctr {
+				c.ctr[j]++
+				if c.ctr[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.ks[:], c.ctr[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.ks[c.used]
+		c.used++
+	}
+}
+
+// aesReader decrypts a WinZip AES entry, whose MAC newAESReader has
+// already checked.
+type aesReader struct {
+	r   io.Reader
+	ctr *winzipCTR
+}
+
+func newAESReader(ctx context.Context, raw *io.SectionReader, password []byte, ae *winzipAES) (*aesReader, error) {
+	head := int64(ae.saltLen + winzipAESCheckLen)
+	if raw.Size() < head+winzipAESMACLen {
+		return nil, fmt.Errorf("WinZip AES entry too short")
+	}
+	buf := make([]byte, head)
+	if _, err := raw.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	salt, check := buf[:ae.saltLen], buf[ae.saltLen:]
+
+	keys := pbkdf2.Key(password, salt, winzipAESIters, 2*ae.keyLen+winzipAESCheckLen, sha1.New)
+	if !hmac.Equal(keys[2*ae.keyLen:], check) {
+		return nil, errBadPassword
+	}
+	block, err := aes.NewCipher(keys[:ae.keyLen])
+	if err != nil {
+		return nil, err
+	}
+	dataLen := raw.Size() - head - winzipAESMACLen
+
+	// check the MAC of all of the ciphertext up front, so that no
+	// plaintext reaches a reader before it is authenticated. A
+	// wrong password that got past the 2 byte check fails here too.
+	// Like a decompression, it can be interrupted via ctx.
+	mac := hmac.New(sha1.New, keys[ae.keyLen:2*ae.keyLen])
+	if _, err := io.Copy(mac, &ctxReader{ctx, io.NewSectionReader(raw, head, dataLen)}); err != nil {
+		return nil, err
+	}
+	tag := make([]byte, winzipAESMACLen)
+	if _, err := raw.ReadAt(tag, head+dataLen); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac.Sum(nil)[:winzipAESMACLen], tag) {
+		VPrintf("newAESReader: WinZip AES authentication failed\n")
+		return nil, errBadPassword
+	}
+	return &aesReader{
+		r:   io.NewSectionReader(raw, head, dataLen),
+		ctr: newWinzipCTR(block),
+	}, nil
+}
+
+func (a *aesReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	a.ctr.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// zipCryptoKeys is the state of the PKWARE stream cipher.
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password []byte) *zipCryptoKeys {
+	k := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for _, b := range password {
+		k.update(b)
+	}
+	return k
+}
+
+func crc32Byte(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ crc>>8
+}
+
+func (k *zipCryptoKeys) update(plain byte) {
+	k[0] = crc32Byte(k[0], plain)
+	k[1] = (k[1]+k[0]&0xff)*134775813 + 1
+	k[2] = crc32Byte(k[2], byte(k[1]>>24))
+}
+
+func (k *zipCryptoKeys) streamByte() byte {
+	t := k[2] | 2
+	return byte(t * (t ^ 1) >> 8)
+}
+
+func (k *zipCryptoKeys) decrypt(buf []byte) {
+	for i, c := range buf {
+		p := c ^ k.streamByte()
+		k.update(p)
+		buf[i] = p
+	}
+}
+
+// zipCryptoReader decrypts a ZipCrypto entry.
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+func newZipCryptoReader(raw *io.SectionReader, password []byte, f *zip.File) (*zipCryptoReader, error) {
+	if raw.Size() < zipCryptoHeaderLen {
+		return nil, fmt.Errorf("ZipCrypto entry too short")
+	}
+	head := make([]byte, zipCryptoHeaderLen)
+	if _, err := raw.ReadAt(head, 0); err != nil {
+		return nil, err
+	}
+	keys := newZipCryptoKeys(password)
+	keys.decrypt(head)
+
+	// the last header byte lets us check the password, though a
+	// wrong one gets past 1 time in 256.
+	check := byte(f.CRC32 >> 24)
+	if f.Flags&dataDescriptorFlag != 0 {
+		check = byte(f.ModifiedTime >> 8)
+	}
+	if head[zipCryptoHeaderLen-1] != check {
+		return nil, errBadPassword
+	}
+	return &zipCryptoReader{
+		r:    io.NewSectionReader(raw, zipCryptoHeaderLen, raw.Size()-zipCryptoHeaderLen),
+		keys: keys,
+	}, nil
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	z.keys.decrypt(p[:n])
+	return n, err
+}
+
+// decryptedEntry decompresses a decrypted entry, and checks its CRC
+// when there is one to check.
+type decryptedEntry struct {
+	dec     io.ReadCloser
+	plain   io.Reader // the decrypted, still compressed, data
+	crc     hash.Hash32
+	wantCRC uint32
+}
+
+func (d *decryptedEntry) Read(p []byte) (int, error) {
+	n, err := d.dec.Read(p)
+	if d.crc != nil {
+		d.crc.Write(p[:n])
+	}
+	if err == io.EOF {
+		// read what is left, if anything, so the CRC sees it all.
+		if _, derr := io.Copy(ioutil.Discard, d.plain); derr != nil {
+			return n, derr
+		}
+		if d.crc != nil && d.crc.Sum32() != d.wantCRC {
+			return n, zip.ErrChecksum
+		}
+	}
+	return n, err
+}
+
+func (d *decryptedEntry) Close() error {
+	return d.dec.Close()
+}
+
+// openEncrypted decrypts f with the password the PasswordProvider
+// gives, returning a stream of its contents.
+func (fsys *FS) openEncrypted(ctx context.Context, f *zip.File) (io.ReadCloser, error) {
+	var password []byte
+	var err error
+	if fsys.opts.PasswordProvider != nil {
+		password, err = fsys.opts.PasswordProvider(f.Name)
+	}
+	if err != nil || password == nil {
+		VPrintf("openEncrypted: no password for '%s': %v\n", f.Name, err)
+		return nil, errBadPassword
+	}
+	raw, err := fsys.compressedData(f)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decryptedEntry{wantCRC: f.CRC32}
+	method := f.Method
+	if f.Method == winzipAESMethod {
+		ae, err := parseWinzipAES(f.Extra)
+		if err != nil {
+			return nil, fmt.Errorf("entry '%s': %s", f.Name, err)
+		}
+		d.plain, err = newAESReader(ctx, raw, password, ae)
+		if err != nil {
+			return nil, err
+		}
+		method = ae.method
+		if ae.version == 1 {
+			d.crc = crc32.NewIEEE()
+		}
+	} else {
+		if !fsys.opts.AllowZipCrypto {
+			VPrintf("openEncrypted: '%s' uses ZipCrypto, and AllowZipCrypto is off\n", f.Name)
+			return nil, errBadPassword
+		}
+		d.plain, err = newZipCryptoReader(raw, password, f)
+		if err != nil {
+			return nil, err
+		}
+		d.crc = crc32.NewIEEE()
+	}
+
+	d.dec, err = decompressor(method, d.plain)
+	if err != nil {
+		return nil, fmt.Errorf("entry '%s': %s", f.Name, err)
+	}
+	return d, nil
+}
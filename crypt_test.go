@@ -0,0 +1,215 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/context"
+)
+
+// addAESEntry writes plain to zw as a WinZip AES-256 entry.
+func addAESEntry(zw *zip.Writer, name string, password, plain []byte, method uint16, version uint16) {
+	data := plain
+	if method == zip.Deflate {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestCompression)
+		w.Write(plain)
+		w.Close()
+		data = buf.Bytes()
+	}
+	salt := []byte("0123456789abcdef")
+	keys := pbkdf2.Key(password, salt, winzipAESIters, 2*32+2, sha1.New)
+	block, err := aes.NewCipher(keys[:32])
+	panicOn(err)
+	ct := make([]byte, len(data))
+	newWinzipCTR(block).XORKeyStream(ct, data)
+	mac := hmac.New(sha1.New, keys[32:64])
+	mac.Write(ct)
+
+	raw := append(append(append(append([]byte{}, salt...), keys[64:]...), ct...), mac.Sum(nil)[:winzipAESMACLen]...)
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra, winzipAESExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], version)
+	copy(extra[6:], "AE")
+	extra[8] = 3
+	binary.LittleEndian.PutUint16(extra[9:], method)
+
+	fh := &zip.FileHeader{
+		Name:               name,
+		Method:             winzipAESMethod,
+		Flags:              0x1,
+		CompressedSize64:   uint64(len(raw)),
+		UncompressedSize64: uint64(len(plain)),
+		Extra:              extra,
+	}
+	if version == 1 {
+		fh.CRC32 = crc32.ChecksumIEEE(plain)
+	}
+	w, err := zw.CreateRaw(fh)
+	panicOn(err)
+	w.Write(raw)
+}
+
+// addZipCryptoEntry writes plain to zw as a stored ZipCrypto entry.
+func addZipCryptoEntry(zw *zip.Writer, name string, password, plain []byte) {
+	crc := crc32.ChecksumIEEE(plain)
+	clear := append([]byte("random head"), byte(crc>>24))
+	clear = append(clear, plain...)
+	keys := newZipCryptoKeys(password)
+	enc := make([]byte, len(clear))
+	for i, p := range clear {
+		enc[i] = p ^ keys.streamByte()
+		keys.update(p)
+	}
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		Flags:              0x1,
+		CRC32:              crc,
+		CompressedSize64:   uint64(len(enc)),
+		UncompressedSize64: uint64(len(plain)),
+	})
+	panicOn(err)
+	w.Write(enc)
+}
+
+func Test020EncryptedEntriesNeedTheirPassword(t *testing.T) {
+
+	cv.Convey("WinZip AES and (when allowed) ZipCrypto entries should read back with the right password, and fail with EACCES without one", t, func() {
+		password := []byte("sesame")
+		plain := bytes.Repeat([]byte("the secret of the pyramids. "), 500)
+
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		addAESEntry(zw, "ae1-deflate", password, plain, zip.Deflate, 1)
+		addAESEntry(zw, "ae2-store", password, plain, zip.Store, 2)
+		addZipCryptoEntry(zw, "zipcrypto", password, plain)
+		panicOn(zw.Close())
+		zipBytes := buf.Bytes()
+		ctx := context.Background()
+		read := func(opts MountOptions, name string) ([]byte, error) {
+			fsys := testFS(zipBytes, opts)
+			node, err := lookupPath(fsys, name)
+			panicOn(err)
+			h, err := node.(*File).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+			if err != nil {
+				return nil, err
+			}
+			defer h.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{})
+			var got []byte
+			for {
+				resp := &fuse.ReadResponse{}
+				err := h.(*FileHandle).Read(ctx, &fuse.ReadRequest{Offset: int64(len(got)), Size: 4096}, resp)
+				if err != nil {
+					return got, err
+				}
+				if len(resp.Data) == 0 {
+					return got, nil
+				}
+				got = append(got, resp.Data...)
+			}
+		}
+		withPassword := func(pw string) PasswordProvider {
+			return func(entryName string) ([]byte, error) {
+				if pw == "" {
+					return nil, fmt.Errorf("no password for '%s'", entryName)
+				}
+				return []byte(pw), nil
+			}
+		}
+
+		for _, name := range []string{"ae1-deflate", "ae2-store"} {
+			got, err := read(MountOptions{PasswordProvider: withPassword("sesame")}, name)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(bytes.Equal(got, plain), cv.ShouldBeTrue)
+
+			_, err = read(MountOptions{PasswordProvider: withPassword("wrong")}, name)
+			cv.So(err, cv.ShouldEqual, errBadPassword)
+			_, err = read(MountOptions{PasswordProvider: withPassword("")}, name)
+			cv.So(err, cv.ShouldEqual, errBadPassword)
+			_, err = read(MountOptions{}, name)
+			cv.So(err, cv.ShouldEqual, errBadPassword)
+		}
+
+		// AES entries are authenticated before any of them is read.
+		good := zipBytes
+		archive, err := zip.NewReader(bytes.NewReader(good), int64(len(good)))
+		panicOn(err)
+		for _, f := range archive.File[:2] {
+			off, err := f.DataOffset()
+			panicOn(err)
+			zipBytes = append([]byte{}, good...)
+			zipBytes[off+16+winzipAESCheckLen+3]++
+			got, err := read(MountOptions{PasswordProvider: withPassword("sesame")}, f.Name)
+			cv.So(err, cv.ShouldEqual, errBadPassword)
+			cv.So(got, cv.ShouldBeNil)
+		}
+		zipBytes = good
+
+		// as can be done of a big one, while it is interrupted.
+		f := archive.File[1]
+		off, err := f.DataOffset()
+		panicOn(err)
+		ae, err := parseWinzipAES(f.Extra)
+		panicOn(err)
+		raw := io.NewSectionReader(bytes.NewReader(good), off, int64(f.CompressedSize64))
+		_, err = newAESReader(ctx, raw, password, ae)
+		cv.So(err, cv.ShouldBeNil)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = newAESReader(cancelled, raw, password, ae)
+		cv.So(err, cv.ShouldEqual, errInterrupted)
+
+		_, err = read(MountOptions{PasswordProvider: withPassword("sesame")}, "zipcrypto")
+		cv.So(err, cv.ShouldEqual, errBadPassword)
+		got, err := read(MountOptions{PasswordProvider: withPassword("sesame"), AllowZipCrypto: true}, "zipcrypto")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(bytes.Equal(got, plain), cv.ShouldBeTrue)
+
+		// writing to one on a writable mount copies up the plaintext,
+		// and only with the password.
+		write := func(opts MountOptions, name string) ([]byte, error) {
+			dir, err := ioutil.TempDir("", "libzipfs-overlay-test")
+			panicOn(err)
+			defer os.RemoveAll(dir)
+			fsys := testFS(zipBytes, opts)
+			fsys.overlay = newOverlay(fsys, dir)
+			root, err := fsys.Root()
+			panicOn(err)
+			node, err := root.(*ovDir).Lookup(ctx, &fuse.LookupRequest{Name: name}, &fuse.LookupResponse{})
+			panicOn(err)
+			h, err := node.(*ovFile).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+			if err != nil {
+				cv.So(exists(filepath.Join(dir, name)), cv.ShouldBeFalse)
+				return nil, err
+			}
+			panicOn(h.(*ovHandle).Write(ctx, &fuse.WriteRequest{Data: []byte("THE")}, &fuse.WriteResponse{}))
+			panicOn(h.(*ovHandle).Release(ctx, &fuse.ReleaseRequest{}))
+			return ioutil.ReadFile(filepath.Join(dir, name))
+		}
+		want := append([]byte("THE"), plain[3:]...)
+		for _, name := range []string{"ae1-deflate", "ae2-store", "zipcrypto"} {
+			got, err := write(MountOptions{PasswordProvider: withPassword("sesame"), AllowZipCrypto: true}, name)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(bytes.Equal(got, want), cv.ShouldBeTrue)
+			_, err = write(MountOptions{PasswordProvider: withPassword("wrong"), AllowZipCrypto: true}, name)
+			cv.So(err, cv.ShouldEqual, errBadPassword)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultDiskCacheDir is the usual MountOptions.DiskCacheDir:
+// $XDG_CACHE_HOME/libzipfs, or ~/.cache/libzipfs.
+func DefaultDiskCacheDir() (string, error) {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return "", fmt.Errorf("neither $XDG_CACHE_HOME nor $HOME is set")
+		}
+		dir = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(dir, "libzipfs"), nil
+}
+
+// diskCachePath is where f's decompressed contents go in the disk
+// cache, or "" if f isn't to be cached there. Only the zips of a
+// combo are cached, in a directory named for the hash algorithm and
+// checksum its footer records, so that a cache can only ever be used
+// with the very zip it was made from; and only once we have checked
+// the zip has that checksum, so that a combo whose footer lies can't
+// fill the cache of another. Each entry is a file named for the
+// offset of its data in the zip.
+func (fsys *FS) diskCachePath(f *zip.File) string {
+	if fsys.opts.DiskCacheDir == "" || isStored(f) || isEncrypted(f) {
+		return ""
+	}
+	fsys.treeMut.RLock()
+	foot, layers := fsys.footer, fsys.layers
+	fsys.treeMut.RUnlock()
+	if foot == nil || !layers[0].verified {
+		return ""
+	}
+	fsys.mut.Lock()
+	ra := fsys.dataOf[f]
+	fsys.mut.Unlock()
+	if ra != layers[0].ra {
+		// from one of the other zips of a union, or a zip
+		// since replaced by a reload.
+		return ""
+	}
+	sum, ok := foot.zipChecksum(layers[0].payload)
+	if !ok {
+		return ""
+	}
+	off, err := f.DataOffset()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(fsys.opts.DiskCacheDir,
+		fmt.Sprintf("%s-%x", foot.HashAlgorithm, sum[:foot.HashAlgorithm.Size()]), fmt.Sprintf("%x", off))
+}
+
+// zipVerified reports whether the zip of the combo layer l, open as
+// al, has the checksum its footer gives, as the disk cache needs.
+// Mounts with VerifyChecksums or RequireSignature have already
+// checked by the time this is called; others with a DiskCacheDir
+// hash the zip here.
+func (o *MountOptions) zipVerified(l ZipLayer, al archiveLayer) bool {
+	if !l.isCombo() {
+		return false
+	}
+	if o.VerifyChecksums || o.RequireSignature {
+		return true
+	}
+	if o.DiskCacheDir == "" {
+		return false
+	}
+	_, foot, err := ComboZipLayer(l.ZipfilePath, l.Payload)
+	if err == nil {
+		err = foot.checkZip(l, al)
+	}
+	if err != nil {
+		VPrintf("not using the disk cache for '%s': %s\n", l.ZipfilePath, err)
+		return false
+	}
+	return true
+}
+
+// diskCached opens f's decompressed contents in the disk cache,
+// writing them there first if this is the first time f has been
+// read. It returns nil, and no error, when f isn't to be cached, or
+// can't be, so that the caller serves it from the zip as usual.
+func (fsys *FS) diskCached(ctx context.Context, f *zip.File) (*os.File, error) {
+	path := fsys.diskCachePath(f)
+	if path == "" {
+		return nil, nil
+	}
+	fd, err := os.Open(path)
+	if err == nil {
+		fi, err := fd.Stat()
+		if err == nil && fi.Size() == int64(f.UncompressedSize64) {
+			return fd, nil
+		}
+		fd.Close()
+	}
+	fd, err = fillDiskCache(ctx, f, path)
+	if err == errInterrupted {
+		return nil, err
+	}
+	if err != nil {
+		VPrintf("diskCached: can't cache '%s' in '%s', serving it from the zip: %s\n", f.Name, path, err)
+		return nil, nil
+	}
+	return fd, nil
+}
+
+// fillDiskCache decompresses f to path. It writes to a temporary
+// file that it renames into place once complete, so that other
+// processes sharing the cache never see part of an entry.
+func fillDiskCache(ctx context.Context, f *zip.File, path string) (*os.File, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile(dir, ".libzipfs-fill-")
+	if err != nil {
+		return nil, err
+	}
+	// read to EOF, so that archive/zip checks the CRC.
+	_, err = io.Copy(tmp, &ctxReader{ctx, r})
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	VPrintf("cached '%s' on disk in '%s'\n", f.Name, path)
+	return tmp, nil
+}
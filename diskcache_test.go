@@ -0,0 +1,100 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+func Test024DiskCacheIsSharedAndKeyedByZipChecksum(t *testing.T) {
+
+	cv.Convey("with DiskCacheDir set, a combo's files should be decompressed to the cache on first read, and served from there by later mounts of the same zip only", t, func() {
+		data := testPayload(24, 200<<10)
+		var zbuf bytes.Buffer
+		zw := zip.NewWriter(&zbuf)
+		w, err := zw.Create("pkg/R/big.rdb")
+		panicOn(err)
+		w.Write(data)
+		zw.Close()
+
+		cacheDir, err := ioutil.TempDir("", "libzipfs.diskcache.")
+		panicOn(err)
+		defer os.RemoveAll(cacheDir)
+
+		// each mount gets its own FS, as another process would.
+		mount := func(sum byte) *FS {
+			fsys := testFS(zbuf.Bytes(), MountOptions{DiskCacheDir: cacheDir})
+			fsys.footer = &Footer{}
+			fsys.footer.ZipfileBlake2Checksum[0] = sum
+			fsys.layers[0].verified = true
+			return fsys
+		}
+		ctx := context.Background()
+		read := func(fsys *FS, off int64) []byte {
+			node, err := lookupPath(fsys, "pkg", "R", "big.rdb")
+			panicOn(err)
+			h, err := node.(*File).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+			panicOn(err)
+			defer h.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{})
+			resp := &fuse.ReadResponse{}
+			panicOn(h.(*FileHandle).Read(ctx, &fuse.ReadRequest{Offset: off, Size: 1000}, resp))
+			return resp.Data
+		}
+
+		first := mount(1)
+		cv.So(read(first, 150000), cv.ShouldResemble, data[150000:151000])
+		path := first.diskCachePath(lookupFile(first, "pkg", "R", "big.rdb"))
+		cv.So(filepath.Dir(filepath.Dir(path)), cv.ShouldEqual, cacheDir)
+		cv.So(filepath.Base(filepath.Dir(path)), cv.ShouldStartWith, "blake2b-01")
+		cached, err := ioutil.ReadFile(path)
+		panicOn(err)
+		cv.So(bytes.Equal(cached, data), cv.ShouldBeTrue)
+
+		// mark the cached copy, so we can tell where reads come from.
+		copy(cached, "from the cache")
+		panicOn(ioutil.WriteFile(path, cached, 0600))
+		cv.So(string(read(mount(1), 0)[:14]), cv.ShouldEqual, "from the cache")
+
+		// a different zip doesn't get to use it.
+		cv.So(read(mount(2), 0), cv.ShouldResemble, data[:1000])
+		dirs, err := ioutil.ReadDir(cacheDir)
+		panicOn(err)
+		cv.So(len(dirs), cv.ShouldEqual, 2)
+
+		// nor does a zip we haven't checked has the checksum its
+		// footer claims.
+		unchecked := mount(1)
+		unchecked.layers[0].verified = false
+		cv.So(unchecked.diskCachePath(lookupFile(unchecked, "pkg", "R", "big.rdb")), cv.ShouldEqual, "")
+		cv.So(read(unchecked, 0), cv.ShouldResemble, data[:1000])
+
+		// Start() hashes the zip of a combo to check it.
+		opts := &MountOptions{DiskCacheDir: cacheDir}
+		verified := func(combo string) bool {
+			l, _, err := ComboZipLayer(combo, "")
+			panicOn(err)
+			fd, al, err := l.open()
+			panicOn(err)
+			defer fd.Close()
+			return opts.zipVerified(l, al)
+		}
+		cv.So(verified("testfiles/expectedCombined"), cv.ShouldBeTrue)
+		_, foot, comb, err := ReadFooter("testfiles/expectedCombined")
+		panicOn(err)
+		comb.Close()
+		by, err := ioutil.ReadFile("testfiles/expectedCombined")
+		panicOn(err)
+		by[foot.ExecutableLengthBytes+31]++
+		spoilt := filepath.Join(cacheDir, "spoilt")
+		panicOn(ioutil.WriteFile(spoilt, by, 0700))
+		cv.So(verified(spoilt), cv.ShouldBeFalse)
+		cv.So((&MountOptions{}).zipVerified(ZipLayer{ZipfilePath: spoilt, FooterBytes: LIBZIPFS_FOOTER_LEN}, archiveLayer{}), cv.ShouldBeFalse)
+	})
+}
@@ -0,0 +1,100 @@
+package libzipfs
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// LookupFold says which differences between the name asked for and
+// the name in the zip Dir.Lookup should overlook, for programs
+// written against case-insensitive filesystems, or zips made on
+// macOS, which stores names decomposed (NFD). Directory listings
+// still show the names as they are in the zip.
+type LookupFold int
+
+const (
+	// FoldCase matches names regardless of case, so that
+	// Logo.PNG finds logo.png.
+	FoldCase LookupFold = 1 << iota
+
+	// FoldUnicode matches names that are the same once Unicode
+	// normalized (to NFC), so that "é" finds an entry that spells
+	// it as "e" followed by a combining acute accent.
+	FoldUnicode
+)
+
+func (m LookupFold) String() string {
+	var s []string
+	if m&FoldCase != 0 {
+		s = append(s, "case")
+	}
+	if m&FoldUnicode != 0 {
+		s = append(s, "unicode")
+	}
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, "+")
+}
+
+// key is what names that m takes to be the same have in common.
+func (m LookupFold) key(name string) string {
+	if m&FoldUnicode != 0 {
+		name = norm.NFC.String(name)
+	}
+	if m&FoldCase != 0 {
+		// a Caser keeps state, so each call gets its own.
+		name = cases.Fold().String(name)
+	}
+	return name
+}
+
+// NameCollision lists the entries of a directory that a LookupFold
+// can't tell apart. Lookups find Names[0], the first in byte order;
+// the others can still be reached by their exact names.
+type NameCollision struct {
+	Dir   string
+	Names []string
+}
+
+func (c NameCollision) String() string {
+	return fmt.Sprintf("in '%s', lookups for %q all find '%s'", c.Dir, c.Names, c.Names[0])
+}
+
+// foldTree fills in the folded lookup maps of the directories at
+// and below n, which is at path dir, and reports any collisions.
+// Children are in name order, so the outcome doesn't depend on the
+// order of the zip.
+func foldTree(n *treeNode, m LookupFold, dir string) []NameCollision {
+	var collisions []NameCollision
+	n.folded = make(map[string]*treeNode, len(n.order))
+	var clash map[string][]string
+	for _, c := range n.order {
+		k := m.key(c.name)
+		if first, taken := n.folded[k]; taken {
+			if clash == nil {
+				clash = make(map[string][]string)
+			}
+			if clash[k] == nil {
+				clash[k] = []string{first.name}
+			}
+			clash[k] = append(clash[k], c.name)
+			continue
+		}
+		n.folded[k] = c
+	}
+	for _, c := range n.order {
+		if names := clash[m.key(c.name)]; names != nil && names[0] == c.name {
+			collisions = append(collisions, NameCollision{Dir: "/" + dir, Names: names})
+		}
+	}
+	for _, c := range n.order {
+		if c.isDir {
+			collisions = append(collisions, foldTree(c, m, joinPath(dir, c.name))...)
+		}
+	}
+	return collisions
+}
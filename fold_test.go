@@ -0,0 +1,46 @@
+package libzipfs
+
+import (
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test019FoldedLookupsFindCaseAndUnicodeVariants(t *testing.T) {
+
+	cv.Convey("with LookupFold set, Lookup should find names differing in case or Unicode normalization, and report collisions the same way whatever the zip order", t, func() {
+		nfd := "cafe\u0301.txt" // as macOS writes it
+		nfc := "caf\u00e9.txt"
+
+		fsys := testArchive("img/logo.png", "docs/"+nfd)
+		cv.So(fsys.buildIndex(), cv.ShouldBeNil)
+		_, err := lookupPath(fsys, "img", "Logo.PNG")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		fsys.opts.LookupFold = FoldCase
+		cv.So(fsys.buildIndex(), cv.ShouldBeNil)
+		logo, err := lookupPath(fsys, "IMG", "Logo.PNG")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(logo.(*File).path, cv.ShouldEqual, "img/logo.png")
+		_, err = lookupPath(fsys, "docs", nfc)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		fsys.opts.LookupFold = FoldCase | FoldUnicode
+		cv.So(fsys.buildIndex(), cv.ShouldBeNil)
+		_, err = lookupPath(fsys, "Docs", "CAF\u00c9.TXT")
+		cv.So(err, cv.ShouldBeNil)
+
+		for _, order := range [][]string{{"README", "readme", "ReadMe"}, {"ReadMe", "readme", "README"}} {
+			fsys := testArchive(order...)
+			fsys.opts.LookupFold = FoldCase
+			cv.So(fsys.buildIndex(), cv.ShouldBeNil)
+			cv.So(fsys.collisions, cv.ShouldResemble, []NameCollision{{Dir: "/", Names: []string{"README", "ReadMe", "readme"}}})
+			r, err := lookupPath(fsys, "rEADME")
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(r.(*File).path, cv.ShouldEqual, "README")
+			r, err = lookupPath(fsys, "readme")
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(r.(*File).path, cv.ShouldEqual, "readme")
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package libzipfs
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/codahale/blake2"
+	"github.com/zeebo/blake3"
+)
+
+// HashAlgorithm says which hash gives the checksums in a footer, and
+// is recorded in its trailer. Checksums shorter than
+// BLAKE2_HASH_LEN are padded out with zeros.
+//
+// HashBLAKE2b is zero, as that is what the byte holding the
+// algorithm was in footers from before there was a choice.
+type HashAlgorithm uint8
+
+const (
+	HashBLAKE2b HashAlgorithm = iota
+	HashSHA256
+	HashSHA512
+	HashBLAKE3
+)
+
+var hashAlgorithmNames = []string{
+	HashBLAKE2b: "blake2b",
+	HashSHA256:  "sha256",
+	HashSHA512:  "sha512",
+	HashBLAKE3:  "blake3",
+}
+
+func (a HashAlgorithm) String() string {
+	if !a.valid() {
+		return fmt.Sprintf("HashAlgorithm(%d)", uint8(a))
+	}
+	return hashAlgorithmNames[a]
+}
+
+func (a HashAlgorithm) valid() bool {
+	return int(a) < len(hashAlgorithmNames)
+}
+
+// ParseHashAlgorithm reads the name of a HashAlgorithm, such as
+// "sha256" or "SHA-256".
+func ParseHashAlgorithm(s string) (HashAlgorithm, error) {
+	name := strings.Replace(strings.ToLower(s), "-", "", -1)
+	for a, n := range hashAlgorithmNames {
+		if n == name {
+			return HashAlgorithm(a), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash algorithm '%s': use one of %s", s, strings.Join(hashAlgorithmNames, ", "))
+}
+
+// Set and String make a *HashAlgorithm a flag.Value.
+func (a *HashAlgorithm) Set(s string) error {
+	alg, err := ParseHashAlgorithm(s)
+	if err != nil {
+		return err
+	}
+	*a = alg
+	return nil
+}
+
+// New gives a new hash.Hash computing a; nil if a is unknown.
+func (a HashAlgorithm) New() hash.Hash {
+	switch a {
+	case HashBLAKE2b:
+		return blake2.New(nil)
+	case HashSHA256:
+		return sha256.New()
+	case HashSHA512:
+		return sha512.New()
+	case HashBLAKE3:
+		return blake3.New()
+	}
+	return nil
+}
+
+// Size is the length of the checksums a gives, before any padding.
+func (a HashAlgorithm) Size() int {
+	h := a.New()
+	if h == nil {
+		return 0
+	}
+	return h.Size()
+}
+
+// padChecksum pads sum out to fill a checksum field of a footer.
+func padChecksum(sum []byte) (c [BLAKE2_HASH_LEN]byte) {
+	copy(c[:], sum)
+	return c
+}
+
+// HashFile gives the checksum by alg of the file at path, and its
+// length.
+func HashFile(path string, alg HashAlgorithm) (hash []byte, length int64, err error) {
+	if !FileExists(path) {
+		return nil, 0, fmt.Errorf("no such file: '%s'", path)
+	}
+	h := alg.New()
+	if h == nil {
+		return nil, 0, fmt.Errorf("HashFile() error: unknown hash algorithm %s", alg)
+	}
+
+	of, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("HashFile() error during opening file '%s': '%s'", path, err)
+	}
+	defer of.Close()
+
+	length, err = io.Copy(h, of)
+	if err != nil {
+		return nil, 0, fmt.Errorf("HashFile() error during reading from file '%s': '%s'", path, err)
+	}
+	hash = h.Sum(nil)
+	VPrintf("%s hash = '%x' for file '%s'\n", alg, hash, path)
+	return hash, length, nil
+}
@@ -0,0 +1,102 @@
+package libzipfs
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test029FootersRecordTheirHashAlgorithm(t *testing.T) {
+
+	cv.Convey("a combo made with any of the hash algorithms should record it in the footer, verify, split and sign with it, and old footers should read as blake2b", t, func() {
+		dir, err := ioutil.TempDir("", "libzipfs.hash.")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		writeTestZip(filepath.Join(dir, "web.zip"), "index.html")
+		keyPath := filepath.Join(dir, "release.key")
+		pub, err := GenerateSigningKey(keyPath)
+		panicOn(err)
+
+		for _, alg := range []HashAlgorithm{HashBLAKE2b, HashSHA256, HashSHA512, HashBLAKE3} {
+			parsed, err := ParseHashAlgorithm(alg.String())
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(parsed, cv.ShouldEqual, alg)
+
+			combo := filepath.Join(dir, "combo."+alg.String())
+			cfg := CombinerConfig{
+				ExecutablePath: "testfiles/tester",
+				ZipfilePath:    "testfiles/hi.zip",
+				OutputPath:     combo,
+				Metadata:       map[string][]byte{"build": []byte("v1.2.3")},
+				Payloads:       []NamedPayload{{Name: "web-assets", Path: filepath.Join(dir, "web.zip")}},
+				SigningKeyPath: keyPath,
+				HashAlgorithm:  alg,
+			}
+			panicOn(DoCombineExeAndZip(&cfg))
+
+			_, foot, comb, err := ReadFooter(combo)
+			cv.So(err, cv.ShouldBeNil)
+			comb.Close()
+			cv.So(foot.HashAlgorithm, cv.ShouldEqual, alg)
+			sum, _, err := HashFile("testfiles/hi.zip", alg)
+			panicOn(err)
+			cv.So(len(sum), cv.ShouldEqual, alg.Size())
+			cv.So(foot.ZipfileBlake2Checksum, cv.ShouldResemble, padChecksum(sum))
+			cv.So(foot.VerifySignature([]ed25519.PublicKey{pub}), cv.ShouldBeNil)
+			msg, err := foot.signedMessage()
+			panicOn(err)
+			cv.So(msg[len(msg)-1], cv.ShouldEqual, byte(alg))
+			cv.So(VerifyCombo(combo), cv.ShouldBeNil)
+
+			split := cfg
+			split.Split = true
+			split.ExecutablePath = filepath.Join(dir, "exe."+alg.String())
+			split.ZipfilePath = filepath.Join(dir, "zip."+alg.String())
+			_, err = DoSplitOutExeAndZip(&split)
+			cv.So(err, cv.ShouldBeNil)
+
+			by, err := ioutil.ReadFile(combo)
+			panicOn(err)
+			by[foot.ExecutableLengthBytes+31]++
+			spoilt := combo + ".spoilt"
+			panicOn(ioutil.WriteFile(spoilt, by, 0755))
+			err = VerifyCombo(spoilt)
+			cerr, ok := err.(*ChecksumError)
+			cv.So(ok, cv.ShouldBeTrue)
+			cv.So(cerr.Region, cv.ShouldEqual, "zipfile")
+			cv.So(cerr.Algorithm, cv.ShouldEqual, alg)
+			cv.So(len(cerr.Got), cv.ShouldEqual, alg.Size())
+
+			// the footer's own checksum covers the algorithm.
+			whole := append(foot.MetadataBytes(), foot.ToBytes()...)
+			start := foot.ExecutableLengthBytes + foot.ZipfileLengthBytes + foot.Payloads[0].Length
+			_, err = ReifyFooterAndDoInexpensiveChecks(whole, combo, start)
+			cv.So(err, cv.ShouldBeNil)
+			for other := HashAlgorithm(0); other <= HashBLAKE3+1; other++ {
+				if other == alg {
+					continue
+				}
+				swapped := *foot
+				swapped.HashAlgorithm = other
+				whole = append(foot.MetadataBytes(), swapped.ToBytes()...)
+				_, err = ReifyFooterAndDoInexpensiveChecks(whole, combo, start)
+				cv.So(err, cv.ShouldNotBeNil)
+			}
+		}
+
+		_, err = ParseHashAlgorithm("md5")
+		cv.So(err, cv.ShouldNotBeNil)
+		alg, err := ParseHashAlgorithm("SHA-256")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(alg, cv.ShouldEqual, HashSHA256)
+
+		_, old, comb, err := ReadFooter("testfiles/expectedCombined")
+		cv.So(err, cv.ShouldBeNil)
+		comb.Close()
+		cv.So(old.HashAlgorithm, cv.ShouldEqual, HashBLAKE2b)
+	})
+}
@@ -0,0 +1,542 @@
+package libzipfs
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+)
+
+// inflater decodes a raw deflate stream (RFC 1951). compress/flate is
+// faster, but it cannot hand over its state; inflater can describe
+// itself as a checkpoint between any two symbols, and later be resumed
+// from that checkpoint. This is what lets a seekIndex serve reads from
+// the middle of a deflated entry.
+
+const (
+	histSize = 32 << 10 // deflate's maximum back-reference distance
+	histMask = histSize - 1
+
+	maxCodeBits = 15
+	fastBits    = 9
+	fastMask    = 1<<fastBits - 1
+
+	maxLitCodes  = 288
+	maxDistCodes = 32
+)
+
+var errCorruptDeflate = errors.New("libzipfs: corrupt deflate data")
+
+var lengthBase = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23,
+	27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+var lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2,
+	2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+var distBase = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129,
+	193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+var distExtra = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6,
+	6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+var codeLenOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+// bitReader hands out the bits of a deflate stream, least significant
+// bit of each byte first, and keeps count of how far in it is.
+type bitReader struct {
+	r     io.ByteReader
+	bits  uint64
+	nbits uint
+	nread int64 // bytes taken from r, counted from the start of the stream
+	err   error
+}
+
+// fill tries to buffer at least n bits; fewer are buffered only at
+// the end of the input.
+func (b *bitReader) fill(n uint) {
+	for b.nbits < n && b.err == nil {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			b.err = err
+			return
+		}
+		b.bits |= uint64(c) << b.nbits
+		b.nbits += 8
+		b.nread++
+	}
+}
+
+func (b *bitReader) take(n uint) (uint32, error) {
+	b.fill(n)
+	if b.nbits < n {
+		return 0, b.shortErr()
+	}
+	v := uint32(b.bits & (1<<n - 1))
+	b.bits >>= n
+	b.nbits -= n
+	return v, nil
+}
+
+func (b *bitReader) shortErr() error {
+	if b.err == nil || b.err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return b.err
+}
+
+// alignByte drops the bits left over in a partially used byte.
+func (b *bitReader) alignByte() {
+	n := b.nbits % 8
+	b.bits >>= n
+	b.nbits -= n
+}
+
+// bitPos is the number of bits consumed so far.
+func (b *bitReader) bitPos() int64 {
+	return b.nread*8 - int64(b.nbits)
+}
+
+// huffman is a canonical Huffman code, decoded through a table of
+// the codes up to fastBits long and bit by bit for the rest.
+type huffman struct {
+	count  [maxCodeBits + 1]uint16
+	symbol [maxLitCodes]uint16
+	fast   [1 << fastBits]uint16 // symbol<<4 | length, 0 if too long
+}
+
+func (h *huffman) init(lengths []uint8) error {
+	*h = huffman{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	h.count[0] = 0
+
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return errCorruptDeflate // over-subscribed
+		}
+	}
+
+	// offs[l] is where the symbols with l-bit codes start in
+	// h.symbol, and next[l] the next l-bit code to hand out.
+	var offs, next [maxCodeBits + 1]uint16
+	code := uint16(0)
+	for l := 1; l <= maxCodeBits; l++ {
+		if l > 1 {
+			offs[l] = offs[l-1] + h.count[l-1]
+		}
+		code = (code + h.count[l-1]) << 1
+		next[l] = code
+	}
+
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		h.symbol[offs[l]] = uint16(sym)
+		offs[l]++
+
+		c := next[l]
+		next[l]++
+		if l > fastBits {
+			continue
+		}
+		rev := reverseBits(c, uint(l))
+		for i := int(rev); i < len(h.fast); i += 1 << l {
+			h.fast[i] = uint16(sym)<<4 | uint16(l)
+		}
+	}
+	return nil
+}
+
+func reverseBits(c uint16, n uint) uint16 {
+	var r uint16
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | c&1
+		c >>= 1
+	}
+	return r
+}
+
+var fixedLit, fixedDist huffman
+var fixedOnce sync.Once
+
+func initFixedTables() {
+	var l [maxLitCodes]uint8
+	for i := range l {
+		switch {
+		case i < 144:
+			l[i] = 8
+		case i < 256:
+			l[i] = 9
+		case i < 280:
+			l[i] = 7
+		default:
+			l[i] = 8
+		}
+	}
+	fixedLit.init(l[:])
+
+	var d [30]uint8
+	for i := range d {
+		d[i] = 5
+	}
+	fixedDist.init(d[:])
+}
+
+const (
+	stateHeader = iota
+	stateStored
+	stateHuffman
+	stateDone
+)
+
+type inflater struct {
+	br bitReader
+
+	hist [histSize]byte
+	hpos int   // where the next output byte goes in hist
+	out  int64 // uncompressed bytes produced so far
+
+	state      int
+	final      bool
+	storedLeft int
+	lit, dist  *huffman
+	dynLit     huffman
+	dynDist    huffman
+	dynLens    []uint8 // code lengths behind dynLit and dynDist
+	dynNLit    int
+	copyLen    int
+	copyDist   int
+	err        error
+
+	// onCheckpoint, if set, is called between symbols once out
+	// reaches nextCheckpoint. It may call checkpoint(), and should
+	// move nextCheckpoint on.
+	onCheckpoint   func(z *inflater)
+	nextCheckpoint int64
+}
+
+func newInflater(r io.Reader) *inflater {
+	fixedOnce.Do(initFixedTables)
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &inflater{br: bitReader{r: br}}
+}
+
+// checkpoint is everything an inflater needs to carry on decoding
+// from a given point.
+type checkpoint struct {
+	bitPos int64  // position in the compressed stream
+	out    int64  // uncompressed offset
+	window []byte // the last (up to) 32KiB of output before out
+
+	state      int
+	final      bool
+	storedLeft int
+	fixed      bool    // in a block using the fixed Huffman codes
+	lens       []uint8 // else in one using these dynamic code lengths
+	nlit       int
+}
+
+func (z *inflater) checkpoint() checkpoint {
+	n := histSize
+	if z.out < histSize {
+		n = int(z.out)
+	}
+	w := make([]byte, n)
+	start := (z.hpos - n) & histMask
+	k := copy(w, z.hist[start:])
+	if k < n {
+		copy(w[k:], z.hist[:n-k])
+	}
+	cp := checkpoint{
+		bitPos:     z.br.bitPos(),
+		out:        z.out,
+		window:     w,
+		state:      z.state,
+		final:      z.final,
+		storedLeft: z.storedLeft,
+	}
+	if z.state == stateHuffman {
+		cp.fixed = z.lit == &fixedLit
+		if !cp.fixed {
+			cp.lens = append([]uint8(nil), z.dynLens...)
+			cp.nlit = z.dynNLit
+		}
+	}
+	return cp
+}
+
+// resumeInflater starts decoding the compressed stream held in ra
+// (of length size) from cp.
+func resumeInflater(ra io.ReaderAt, size int64, cp *checkpoint) (*inflater, error) {
+	start := cp.bitPos / 8
+	z := newInflater(io.NewSectionReader(ra, start, size-start))
+	z.br.nread = start
+	if _, err := z.br.take(uint(cp.bitPos % 8)); err != nil {
+		return nil, err
+	}
+	z.hpos = copy(z.hist[:], cp.window) & histMask
+	z.out = cp.out
+	z.state = cp.state
+	z.final = cp.final
+	z.storedLeft = cp.storedLeft
+	if cp.state == stateHuffman {
+		if cp.fixed {
+			z.lit, z.dist = &fixedLit, &fixedDist
+		} else {
+			if err := z.setDynamicTables(cp.lens, cp.nlit); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return z, nil
+}
+
+func (z *inflater) emit(c byte) {
+	z.hist[z.hpos] = c
+	z.hpos = (z.hpos + 1) & histMask
+	z.out++
+}
+
+func (z *inflater) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if z.err != nil {
+			return n, z.err
+		}
+		if z.onCheckpoint != nil && z.out >= z.nextCheckpoint && z.copyLen == 0 && z.state != stateDone {
+			z.onCheckpoint(z)
+		}
+		switch z.state {
+		case stateHeader:
+			if z.final {
+				z.state = stateDone
+				continue
+			}
+			z.err = z.nextBlock()
+
+		case stateStored:
+			if z.storedLeft == 0 {
+				z.state = stateHeader
+				continue
+			}
+			c, err := z.br.take(8)
+			if err != nil {
+				z.err = err
+				continue
+			}
+			z.emit(byte(c))
+			p[n] = byte(c)
+			n++
+			z.storedLeft--
+
+		case stateHuffman:
+			if z.copyLen > 0 {
+				c := z.hist[(z.hpos-z.copyDist)&histMask]
+				z.emit(c)
+				p[n] = c
+				n++
+				z.copyLen--
+				continue
+			}
+			z.err = z.nextSymbol(p, &n)
+
+		case stateDone:
+			z.err = io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (z *inflater) nextBlock() error {
+	hdr, err := z.br.take(3)
+	if err != nil {
+		return err
+	}
+	z.final = hdr&1 == 1
+	switch hdr >> 1 {
+	case 0:
+		z.br.alignByte()
+		ln, err := z.br.take(16)
+		if err != nil {
+			return err
+		}
+		nln, err := z.br.take(16)
+		if err != nil {
+			return err
+		}
+		if ln != ^nln&0xffff {
+			return errCorruptDeflate
+		}
+		z.storedLeft = int(ln)
+		z.state = stateStored
+	case 1:
+		z.lit, z.dist = &fixedLit, &fixedDist
+		z.state = stateHuffman
+	case 2:
+		if err := z.readDynamicTables(); err != nil {
+			return err
+		}
+		z.state = stateHuffman
+	default:
+		return errCorruptDeflate
+	}
+	return nil
+}
+
+func (z *inflater) readDynamicTables() error {
+	v, err := z.br.take(14)
+	if err != nil {
+		return err
+	}
+	nlen := int(v&0x1f) + 257
+	ndist := int(v>>5&0x1f) + 1
+	ncode := int(v>>10) + 4
+	if nlen > 286 || ndist > 30 {
+		return errCorruptDeflate
+	}
+
+	var lengths [maxLitCodes + maxDistCodes]uint8
+	for i := 0; i < ncode; i++ {
+		l, err := z.br.take(3)
+		if err != nil {
+			return err
+		}
+		lengths[codeLenOrder[i]] = uint8(l)
+	}
+	var lencode huffman
+	if err := lencode.init(lengths[:19]); err != nil {
+		return err
+	}
+
+	for i := range lengths[:19] {
+		lengths[i] = 0
+	}
+	for i := 0; i < nlen+ndist; {
+		sym, err := z.decode(&lencode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var fill uint8
+		var rep uint32
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errCorruptDeflate
+			}
+			fill = lengths[i-1]
+			rep, err = z.br.take(2)
+			rep += 3
+		case 17:
+			rep, err = z.br.take(3)
+			rep += 3
+		default:
+			rep, err = z.br.take(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(rep) > nlen+ndist {
+			return errCorruptDeflate
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = fill
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return errCorruptDeflate // no end-of-block code
+	}
+	return z.setDynamicTables(lengths[:nlen+ndist], nlen)
+}
+
+func (z *inflater) setDynamicTables(lens []uint8, nlit int) error {
+	if err := z.dynLit.init(lens[:nlit]); err != nil {
+		return err
+	}
+	if err := z.dynDist.init(lens[nlit:]); err != nil {
+		return err
+	}
+	z.dynLens = append(z.dynLens[:0], lens...)
+	z.dynNLit = nlit
+	z.lit, z.dist = &z.dynLit, &z.dynDist
+	return nil
+}
+
+func (z *inflater) decode(h *huffman) (int, error) {
+	z.br.fill(fastBits)
+	if e := h.fast[z.br.bits&fastMask]; e != 0 && uint(e&15) <= z.br.nbits {
+		z.br.bits >>= e & 15
+		z.br.nbits -= uint(e & 15)
+		return int(e >> 4), nil
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeBits; l++ {
+		b, err := z.br.take(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		count := int(h.count[l])
+		if code-count < first {
+			return int(h.symbol[index+(code-first)]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errCorruptDeflate
+}
+
+func (z *inflater) nextSymbol(p []byte, n *int) error {
+	sym, err := z.decode(z.lit)
+	if err != nil {
+		return err
+	}
+	switch {
+	case sym < 256:
+		z.emit(byte(sym))
+		p[*n] = byte(sym)
+		*n++
+		return nil
+	case sym == 256:
+		z.state = stateHeader
+		return nil
+	case sym > 285:
+		return errCorruptDeflate
+	}
+
+	sym -= 257
+	extra, err := z.br.take(uint(lengthExtra[sym]))
+	if err != nil {
+		return err
+	}
+	length := int(lengthBase[sym]) + int(extra)
+
+	dsym, err := z.decode(z.dist)
+	if err != nil {
+		return err
+	}
+	if dsym >= 30 {
+		return errCorruptDeflate
+	}
+	extra, err = z.br.take(uint(distExtra[dsym]))
+	if err != nil {
+		return err
+	}
+	dist := int(distBase[dsym]) + int(extra)
+	if int64(dist) > z.out {
+		return errCorruptDeflate // reaches back before the start
+	}
+	z.copyLen, z.copyDist = length, dist
+	return nil
+}
@@ -0,0 +1,81 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+// somewhat compressible test data: random words, some random bytes.
+func testPayload(seed int64, n int) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	words := []string{"salutations", "libzipfs", "zip", "fuse", "mount", "the ", "\n", "R", ".rdb "}
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		if rnd.Intn(10) == 0 {
+			buf.WriteByte(byte(rnd.Intn(256)))
+			continue
+		}
+		buf.WriteString(words[rnd.Intn(len(words))])
+	}
+	return buf.Bytes()[:n]
+}
+
+func Test007InflaterMatchesCompressFlate(t *testing.T) {
+
+	cv.Convey("our resumable inflater should decode exactly what compress/flate encodes, at every compression level", t, func() {
+		data := testPayload(7, 300<<10)
+		for _, level := range []int{flate.HuffmanOnly, flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+			var comp bytes.Buffer
+			w, err := flate.NewWriter(&comp, level)
+			panicOn(err)
+			w.Write(data)
+			w.Close()
+
+			got, err := ioutil.ReadAll(newInflater(bytes.NewReader(comp.Bytes())))
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(bytes.Equal(got, data), cv.ShouldBeTrue)
+		}
+	})
+
+	cv.Convey("a deflated zip entry should read back correctly at any offset, via its seek index", t, func() {
+		data := testPayload(8, 500<<10)
+		var zbuf bytes.Buffer
+		zw := zip.NewWriter(&zbuf)
+		w, err := zw.Create("big.rdb")
+		panicOn(err)
+		w.Write(data)
+		zw.Close()
+
+		fsys := testFS(zbuf.Bytes(), MountOptions{SeekCheckpointKiB: 16})
+		archive := fsys.layers[0].archive
+
+		ix, err := fsys.seekIndexFor(context.Background(), archive.File[0])
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(ix.points), cv.ShouldBeGreaterThan, 4)
+
+		d, err := newDeflateReaderAt(fsys, archive.File[0])
+		panicOn(err)
+		defer d.Close()
+
+		rnd := rand.New(rand.NewSource(9))
+		for i := 0; i < 50; i++ {
+			off := rnd.Int63n(int64(len(data)))
+			buf := make([]byte, 4096)
+			n, err := d.ReadAt(buf, off)
+			want := data[off:]
+			if len(want) > len(buf) {
+				want = want[:len(buf)]
+				cv.So(err, cv.ShouldBeNil)
+			}
+			cv.So(n, cv.ShouldEqual, len(want))
+			cv.So(bytes.Equal(buf[:n], want), cv.ShouldBeTrue)
+		}
+	})
+}
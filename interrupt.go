@@ -0,0 +1,45 @@
+package libzipfs
+
+import (
+	"io"
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// errInterrupted is what a request gets when the kernel interrupts
+// it, say because the process reading has been killed, and fs.Server
+// cancels its context.
+var errInterrupted = fuse.Errno(syscall.EINTR)
+
+// interrupted returns errInterrupted once ctx has been cancelled.
+func interrupted(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return errInterrupted
+	default:
+		return nil
+	}
+}
+
+// ctxReader stops reading from r, with errInterrupted, once ctx has
+// been cancelled. Wrapping the reader a long decompression pulls
+// from, or pushes its output through, makes it give up within a
+// buffer's worth of work.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := interrupted(c.ctx); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// ctxReaderAt is an io.ReaderAt whose reads can be interrupted.
+type ctxReaderAt interface {
+	readAtCtx(ctx context.Context, p []byte, off int64) (int, error)
+}
@@ -0,0 +1,78 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+// cancelAfterFirstRead hands out n bytes at a time from r, and
+// cancels the request context after the first read.
+type cancelAfterFirstRead struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfterFirstRead) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.cancel()
+	return n, err
+}
+
+func (c *cancelAfterFirstRead) Close() error { return nil }
+
+func Test022InterruptedRequestsGiveEINTR(t *testing.T) {
+
+	cv.Convey("cancelled lookups, opens and reads should fail with EINTR, and leave the handle good for the reads after", t, func() {
+		data := testPayload(22, 500<<10)
+		var zbuf bytes.Buffer
+		zw := zip.NewWriter(&zbuf)
+		w, err := zw.Create("big.rdb")
+		panicOn(err)
+		w.Write(data)
+		zw.Close()
+
+		fsys := testFS(zbuf.Bytes(), MountOptions{SeekCheckpointKiB: 16})
+
+		live := context.Background()
+		dead, cancel := context.WithCancel(live)
+		cancel()
+
+		root, err := fsys.Root()
+		panicOn(err)
+		_, err = root.(*Dir).Lookup(dead, &fuse.LookupRequest{Name: "big.rdb"}, &fuse.LookupResponse{})
+		cv.So(err, cv.ShouldEqual, errInterrupted)
+		node, err := root.(*Dir).Lookup(live, &fuse.LookupRequest{Name: "big.rdb"}, &fuse.LookupResponse{})
+		cv.So(err, cv.ShouldBeNil)
+
+		_, err = node.(*File).Open(dead, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+		cv.So(err, cv.ShouldEqual, errInterrupted)
+		h, err := node.(*File).Open(live, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+		cv.So(err, cv.ShouldBeNil)
+		fh := h.(*FileHandle)
+		defer fh.Release(live, &fuse.ReleaseRequest{})
+
+		// a read far in needs the seek index, which we don't get to build.
+		off := int64(400 << 10)
+		resp := &fuse.ReadResponse{}
+		cv.So(fh.Read(dead, &fuse.ReadRequest{Offset: off, Size: 4096}, resp), cv.ShouldEqual, errInterrupted)
+		cv.So(fh.Read(live, &fuse.ReadRequest{Offset: off, Size: 4096}, resp), cv.ShouldBeNil)
+		cv.So(bytes.Equal(resp.Data, data[off:off+4096]), cv.ShouldBeTrue)
+
+		// a stream interrupted part way through a read keeps what it had read.
+		ctx, cancel := context.WithCancel(live)
+		sh := &FileHandle{r: &cancelAfterFirstRead{r: bytes.NewReader(data), n: 1000, cancel: cancel}}
+		cv.So(sh.Read(ctx, &fuse.ReadRequest{Size: 4096}, resp), cv.ShouldEqual, errInterrupted)
+		cv.So(sh.Read(live, &fuse.ReadRequest{Size: 4096}, resp), cv.ShouldBeNil)
+		cv.So(bytes.Equal(resp.Data, data[:4096]), cv.ShouldBeTrue)
+	})
+}
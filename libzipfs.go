@@ -1,6 +1,8 @@
 package libzipfs
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,6 +10,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"archive/zip"
 
@@ -33,14 +36,169 @@ func DisplayVersionAndExitIfRequested() {
 	}
 }
 
-// We assume the zip file contains entries for directories too.
-
 var progName = filepath.Base(os.Args[0])
 
+// DefaultSeekCheckpointKiB is the spacing between seek index
+// checkpoints used when MountOptions.SeekCheckpointKiB is zero.
+const DefaultSeekCheckpointKiB = 512
+
+// MountOptions adjust how a FuseZipFs serves its archive. The zero
+// value gives the defaults. Set them before calling Start().
+type MountOptions struct {
+	// SeekCheckpointKiB is how far apart, in KiB of uncompressed
+	// output, we record decompressor checkpoints for deflated
+	// entries. Smaller means faster seeks but more memory.
+	SeekCheckpointKiB int
+
+	// SymlinkPolicy handles symlinks that point outside the archive.
+	SymlinkPolicy SymlinkPolicy
+
+	// Uid and Gid own every entry. Zips don't record owners, so
+	// by default everything belongs to root.
+	Uid uint32
+	Gid uint32
+
+	// FileMode and DirMode, when non-zero, replace the permission
+	// bits recorded in the zip for files and directories.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// FileMask and DirMask are permission bits to clear from files
+	// and directories, like the fmask and dmask options of vfat.
+	FileMask os.FileMode
+	DirMask  os.FileMode
+
+	// StripSetuid clears any setuid and setgid bits.
+	StripSetuid bool
+
+	// Writable lays a writable layer over the zip: creates, writes,
+	// renames and deletes go to OverlayDir, and unchanged files keep
+	// coming from the zip. If OverlayDir is empty, a temporary
+	// directory is used, and removed again by Stop(). Start() fails
+	// if OverlayDir is set without Writable.
+	Writable   bool
+	OverlayDir string
+
+	// QuarantineDir, if set, is a top-level directory to serve
+	// entries whose names are unsafe (see CleanEntryName) in, under
+	// their %-escaped names. Otherwise they are left out. Either way,
+	// FuseZipFs.UnsafeNames() lists them.
+	QuarantineDir string
+
+	// PasswordProvider supplies the passwords for encrypted
+	// entries. WinZip AES is always understood; AllowZipCrypto
+	// also lets us serve entries in the old, weak, PKWARE ZipCrypto.
+	// Opening an encrypted entry without a valid password fails
+	// with EACCES; see PasswordProvider for what is authenticated
+	// when.
+	PasswordProvider PasswordProvider
+	AllowZipCrypto   bool
+
+	// LookupFold makes lookups overlook differences in case and/or
+	// Unicode normalization between the name asked for and the
+	// name in the zip. Writable mounts always match exactly.
+	LookupFold LookupFold
+
+	// Subdir, if set, mounts just that directory of the zip, e.g.
+	// "assets" to serve assets/logo.png as logo.png. Nothing
+	// outside it can be reached through the mount.
+	Subdir string
+
+	// Watch has Start() poll the zip files every WatchInterval
+	// (default DefaultWatchInterval), and switch over to serving
+	// a new version once one has been written. Handles opened
+	// before keep reading the old version, so write the new zip
+	// elsewhere and rename it into place, as most tools do.
+	Watch         bool
+	WatchInterval time.Duration
+
+	// EntryValid and AttrValid say how long the kernel may cache
+	// lookups and attributes (0 => the default of a minute). The
+	// zip can't change under a mount, so these can be long; a
+	// Writable mount keeps the defaults. KeepCache lets the kernel
+	// keep file contents in its page cache from one open to the
+	// next.
+	EntryValid time.Duration
+	AttrValid  time.Duration
+	KeepCache  bool
+
+	// CacheBytes, if positive, keeps up to that many bytes of
+	// decompressed file contents in memory, so that files opened
+	// again and again are only decompressed once; the least
+	// recently used are dropped first. Only files of at most
+	// CacheFileBytes (0 => DefaultCacheFileBytes) are kept.
+	CacheBytes     int64
+	CacheFileBytes int64
+
+	// DiskCacheDir, if set, is where to keep the decompressed
+	// contents of files, e.g. DefaultDiskCacheDir(), so that they
+	// are decompressed just once, the first time they are read,
+	// by this process or any other mounting the same combo. Only
+	// combo files are cached, as their footer says which zip they
+	// hold; Start() hashes the zip to check it, unless
+	// VerifyChecksums or RequireSignature already do.
+	DiskCacheDir string
+
+	// RequireSignature refuses to serve any zip that is not a
+	// combo, or its payload, signed by one of TrustedKeys, and
+	// checks that the zip has the checksum the signature vouches
+	// for, before Start() serves it. Start() returns a
+	// *SignatureError for one that isn't.
+	RequireSignature bool
+	// TrustedKeys are the keys RequireSignature accepts for this
+	// mount; if empty, the package's TrustedKeys.
+	TrustedKeys []ed25519.PublicKey
+
+	// VerifyChecksums has Start() hash the executable and the zip
+	// (or payload) of each combo file before serving it, and fail
+	// with a *ChecksumError naming the region that doesn't have
+	// the checksum its footer records. This reads the whole of the
+	// exe and zip, once, at every mount.
+	VerifyChecksums bool
+}
+
+// trustedKeys are the keys whose signatures the mount accepts.
+func (o *MountOptions) trustedKeys() []ed25519.PublicKey {
+	if len(o.TrustedKeys) > 0 {
+		return o.TrustedKeys
+	}
+	return TrustedKeys
+}
+
+// applyAttr adjusts attributes taken from the zip as the options say.
+func (o *MountOptions) applyAttr(a *fuse.Attr) {
+	a.Uid = o.Uid
+	a.Gid = o.Gid
+
+	perm := a.Mode & os.ModePerm
+	switch {
+	case a.Mode.IsDir():
+		if o.DirMode != 0 {
+			perm = o.DirMode & os.ModePerm
+		}
+		perm &^= o.DirMask
+	case a.Mode.IsRegular():
+		if o.FileMode != 0 {
+			perm = o.FileMode & os.ModePerm
+		}
+		perm &^= o.FileMask
+	}
+	a.Mode = a.Mode&^os.ModePerm | perm
+
+	if o.StripSetuid {
+		a.Mode &^= os.ModeSetuid | os.ModeSetgid
+	}
+	if o.AttrValid != 0 {
+		a.Valid = o.AttrValid
+	}
+}
+
 type FuseZipFs struct {
 	ZipfilePath string
 	MountPoint  string
 
+	MountOptions
+
 	Ready   chan bool
 	ReqStop chan bool
 	Done    chan bool
@@ -50,40 +208,31 @@ type FuseZipFs struct {
 	serveErr error
 	connErr  error
 	conn     *fuse.Conn
+	srv      *fs.Server
 
 	filesys *FS
-	//archive *zip.ReadCloser
-	archive *zip.Reader
 
-	offset      int64
-	bytesAvail  int64 // -1 => unknown
-	footerBytes int64
+	// the zips to serve, highest priority first. layers[0] is
+	// ZipfilePath.
+	layers []ZipLayer
 
-	fd *os.File
+	// an overlay directory we made, and must clean up in Stop().
+	tempOverlayDir string
 }
 
 // Mount a possibly combined/zipfile at mountpiont. Call Start() to start servicing fuse reads.
 //
-// If the file has a libzipfs footer on it, set footerBytes == LIBZIPFS_FOOTER_LEN.
+// If the file has a libzipfs footer on it, set footerBytes to its FooterLengthBytes
+// (LIBZIPFS_FOOTER_LEN for a v00 footer).
 // The bytesAvail value should describe how long the zipfile is in bytes, and byteOffsetToZipFileStart
 // should describe how far into the (possibly combined) zipFilePath the actual zipfile starts.
 func NewFuseZipFs(zipFilePath, mountpoint string, byteOffsetToZipFileStart int64, bytesAvail int64, footerBytes int64) *FuseZipFs {
-
-	// must trim any trailing slash from the mountpoint, or else mount can fail
-	mountpoint = TrimTrailingSlashes(mountpoint)
-
-	p := &FuseZipFs{
-		ZipfilePath: zipFilePath,
-		MountPoint:  mountpoint,
-		Ready:       make(chan bool),
-		ReqStop:     make(chan bool),
-		Done:        make(chan bool),
-		offset:      byteOffsetToZipFileStart,
-		bytesAvail:  bytesAvail,
-		footerBytes: footerBytes,
-	}
-
-	return p
+	return NewUnionFuseZipFs([]ZipLayer{{
+		ZipfilePath:              zipFilePath,
+		ByteOffsetToZipFileStart: byteOffsetToZipFileStart,
+		BytesAvail:               bytesAvail,
+		FooterBytes:              footerBytes,
+	}}, mountpoint)
 }
 
 // The Main API entry point for mounting a combo file vis FUSE to make
@@ -91,11 +240,30 @@ func NewFuseZipFs(zipFilePath, mountpoint string, byteOffsetToZipFileStart int64
 // fzfs.Stop() when/if they wish to stop serving files at mountpoint.
 //
 func MountComboZip() (fzfs *FuseZipFs, mountpoint string, err error) {
+	return MountComboZipWithOptions(MountOptions{})
+}
+
+// MountComboZipWithOptions is MountComboZip, serving the embedded
+// Zip file as opts say.
+func MountComboZipWithOptions(opts MountOptions) (fzfs *FuseZipFs, mountpoint string, err error) {
+	return MountComboZipNamedWithOptions("", opts)
+}
+
+// MountComboZipNamed is MountComboZip for the payload called name,
+// added to the combo with libzipfs-combiner -payload name=path.
+func MountComboZipNamed(name string) (fzfs *FuseZipFs, mountpoint string, err error) {
+	return MountComboZipNamedWithOptions(name, MountOptions{})
+}
+
+// MountComboZipNamedWithOptions is MountComboZipNamed, serving the
+// payload as opts say.
+func MountComboZipNamedWithOptions(name string, opts MountOptions) (fzfs *FuseZipFs, mountpoint string, err error) {
 	comboFilePath := os.Args[0]
-	fzfs, mountpoint, err = NewFuzeZipFsFromCombo(comboFilePath)
+	fzfs, mountpoint, err = NewFuzeZipFsFromComboNamed(comboFilePath, name)
 	if err != nil {
 		return nil, "", err
 	}
+	fzfs.MountOptions = opts
 	err = fzfs.Start()
 	if err != nil {
 		return nil, "", err
@@ -107,6 +275,19 @@ func MountComboZip() (fzfs *FuseZipFs, mountpoint string, err error) {
 // just for this purpose, and return the mountpoint and a handle to the
 // fuse fileserver in fzfs.
 func NewFuzeZipFsFromCombo(comboFilePath string) (fzfs *FuseZipFs, mountpoint string, err error) {
+	return NewFuzeZipFsFromComboNamed(comboFilePath, "")
+}
+
+// NewFuzeZipFsFromComboNamed is NewFuzeZipFsFromCombo for the
+// payload called name ("" => the zip).
+func NewFuzeZipFsFromComboNamed(comboFilePath, name string) (fzfs *FuseZipFs, mountpoint string, err error) {
+	layer, _, err := ComboZipLayer(comboFilePath, name)
+	if err != nil {
+		return nil, "", fmt.Errorf("NewFuzeZipFsFromCombo() error, could not reader "+
+			"Footer from comboFilePath '%s': '%s'",
+			comboFilePath, err)
+	}
+
 	dir := "" // => use system tmp dir
 	mountPoint, err := ioutil.TempDir(dir, "libzipfs.auto-combo.")
 	if err != nil {
@@ -114,17 +295,30 @@ func NewFuzeZipFsFromCombo(comboFilePath string) (fzfs *FuseZipFs, mountpoint st
 	}
 	VPrintf("\n\n mountPoint = '%s'\n", mountPoint)
 
-	_, foot, comb, err := ReadFooter(comboFilePath)
-	if err != nil {
-		return nil, "", fmt.Errorf("NewFuzeZipFsFromCombo() error, could not reader "+
-			"Footer from comboFilePath '%s': '%s'",
-			comboFilePath, err)
+	z := NewUnionFuseZipFs([]ZipLayer{layer}, mountPoint)
+	return z, mountPoint, nil
+}
+
+// UnsafeNames lists the entries that Start() found to have unsafe
+// names, which were left out of the mount or quarantined.
+func (p *FuseZipFs) UnsafeNames() []UnsafeName {
+	if p.filesys == nil {
+		return nil
 	}
-	defer comb.Close()
-	byteOffsetToZipFileStart := foot.ExecutableLengthBytes
+	p.filesys.treeMut.RLock()
+	defer p.filesys.treeMut.RUnlock()
+	return p.filesys.unsafe
+}
 
-	z := NewFuseZipFs(comboFilePath, mountPoint, byteOffsetToZipFileStart, foot.ZipfileLengthBytes, LIBZIPFS_FOOTER_LEN)
-	return z, mountPoint, nil
+// FoldCollisions lists the names that the LookupFold option made
+// indistinguishable, and which of them lookups find.
+func (p *FuseZipFs) FoldCollisions() []NameCollision {
+	if p.filesys == nil {
+		return nil
+	}
+	p.filesys.treeMut.RLock()
+	defer p.filesys.treeMut.RUnlock()
+	return p.filesys.collisions
 }
 
 func (p *FuseZipFs) Stop() error {
@@ -142,8 +336,11 @@ func (p *FuseZipFs) Stop() error {
 	p.stopped = true
 	<-p.Done
 
-	p.fd.Close()
+	p.filesys.closeLayers()
 	p.conn.Close()
+	if p.tempOverlayDir != "" {
+		os.RemoveAll(p.tempOverlayDir)
+	}
 
 	//  we don't do the following anymore since forcing the unmount
 	//  always results in 'bad file descriptor'.
@@ -157,41 +354,100 @@ func (p *FuseZipFs) Stop() error {
 	return p.connErr
 }
 
-func (p *FuseZipFs) Start() error {
-	var err error
+func (p *FuseZipFs) Start() (err error) {
+	if p.OverlayDir != "" && !p.Writable {
+		return fmt.Errorf("FuseZipFs.Start() error: OverlayDir '%s' is set, but Writable is not", p.OverlayDir)
+	}
+	quarantine, err := p.quarantineDir()
+	if err != nil {
+		return fmt.Errorf("FuseZipFs.Start() error: %s", err)
+	}
+	var layers []archiveLayer
+	defer func() {
+		// until we are mounted, there is no Stop() to close them.
+		if err != nil && p.conn == nil {
+			for _, l := range layers {
+				l.file.fd.Close()
+			}
+		}
+	}()
+	for i := range p.layers {
+		fd, l, err := p.layers[i].open()
+		if err != nil {
+			return err
+		}
+		layers = append(layers, l)
+		if p.VerifyChecksums {
+			err = checkChecksums(p.layers[i], fd, l)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.RequireSignature {
+		for i := range layers {
+			err = checkSignature(p.layers[i], layers[i], p.trustedKeys())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	layers[0].verified = p.zipVerified(p.layers[0], layers[0])
 
-	if p.bytesAvail <= 0 {
-		statinfo, err := os.Stat(p.ZipfilePath)
+	var foot *Footer
+	if p.layers[0].isCombo() {
+		var comb *os.File
+		_, foot, comb, err = ReadFooter(p.ZipfilePath)
 		if err != nil {
 			return err
 		}
-		p.bytesAvail = statinfo.Size() - (p.offset + p.footerBytes)
-		if p.bytesAvail <= 0 {
-			return fmt.Errorf("FuseZipFs.Start() error: no bytes available to read from ZipfilePath '%s' (of size %d bytes) after subtracting offset %d", p.ZipfilePath, statinfo.Size(), p.offset)
+		comb.Close()
+	}
+
+	overlayDir := p.OverlayDir
+	if p.Writable && overlayDir == "" {
+		overlayDir, err = ioutil.TempDir("", "libzipfs.overlay.")
+		if err != nil {
+			return fmt.Errorf("FuseZipFs.Start() error: could not create overlay directory: '%s'", err)
 		}
+		p.tempOverlayDir = overlayDir
+		defer func() {
+			// until we are mounted, there is no Stop() to remove it.
+			if err != nil && p.conn == nil {
+				os.RemoveAll(overlayDir)
+				p.tempOverlayDir = ""
+			}
+		}()
 	}
 
-	fd, err := os.Open(p.ZipfilePath)
-	if err != nil {
-		return err
+	var mountOpts []fuse.MountOption
+	if overlayDir == "" {
+		mountOpts = append(mountOpts, fuse.ReadOnly())
+	} else if !DirExists(overlayDir) {
+		return fmt.Errorf("FuseZipFs.Start() error: overlay directory '%s' not found", overlayDir)
 	}
-	p.fd = fd
-	rat := io.NewSectionReader(p.fd, p.offset, p.bytesAvail)
 
-	p.archive, err = zip.NewReader(rat, p.bytesAvail)
+	p.filesys = &FS{
+		layers: layers,
+		opts:   p.MountOptions,
+		footer: foot,
+	}
+	p.filesys.opts.QuarantineDir = quarantine
+	err = p.filesys.buildIndex()
 	if err != nil {
-		return err
+		return fmt.Errorf("FuseZipFs.Start() error: %s", err)
+	}
+	if overlayDir != "" {
+		p.filesys.overlay = newOverlay(p.filesys, overlayDir)
 	}
 
-	c, err := fuse.Mount(p.MountPoint)
+	c, err := fuse.Mount(p.MountPoint, mountOpts...)
 	if err != nil {
 		return err
 	}
 	p.conn = c
-
-	p.filesys = &FS{
-		archive: p.archive,
-	}
+	p.srv = fs.New(c, nil)
 
 	go func() {
 		select {
@@ -202,7 +458,7 @@ func (p *FuseZipFs) Start() error {
 	}()
 
 	go func() {
-		p.serveErr = fs.Serve(c, p.filesys)
+		p.serveErr = p.srv.Serve(p.filesys)
 
 		// shutdown sequence: possibly requested, possibly an error.
 		close(p.Done)
@@ -214,26 +470,86 @@ func (p *FuseZipFs) Start() error {
 	}
 	close(p.Ready)
 
+	if p.Watch {
+		go p.watch()
+	}
 	return nil
 }
 
 type FS struct {
-	archive *zip.Reader
+	opts MountOptions
+
+	// treeMut guards the fields below it, which a reload (see
+	// MountOptions.Watch) swaps out.
+	treeMut sync.RWMutex
+	// the zips we serve, highest priority first.
+	layers []archiveLayer
+	root   *treeNode
+	// nil unless we are serving a combo file
+	footer *Footer
+	// for Statfs
+	entries      uint64
+	payloadBytes uint64
+	// entries with names we could not serve as they are
+	unsafe []UnsafeName
+	// names that opts.LookupFold can't tell apart
+	collisions []NameCollision
+
+	// the node the kernel knows as the root, whatever the
+	// current tree is.
+	rootDir *Dir
+
+	// nil unless the mount is Writable
+	overlay *overlay
+
+	mut     sync.Mutex
+	indexes map[*zip.File]*indexEntry
+	cache   *contentCache // see contentCache()
+	// the bytes each entry was read from; stored entries are
+	// served straight out of here so that they are seekable.
+	dataOf map[*zip.File]io.ReaderAt
+	// layers a reload has replaced that are still in use.
+	retired map[*layerFile]bool
 }
 
 var _ fs.FS = (*FS)(nil)
 
 func (f *FS) Root() (fs.Node, error) {
-	n := &Dir{
-		archive: f.archive,
+	if f.overlay != nil {
+		return f.overlay.node("", true), nil
 	}
-	return n, nil
+	root, _ := f.current()
+	return root.node, nil
+}
+
+// current returns the tree being served, and its footer.
+func (f *FS) current() (*treeNode, *Footer) {
+	f.treeMut.RLock()
+	defer f.treeMut.RUnlock()
+	return f.root, f.footer
 }
 
 type Dir struct {
-	archive *zip.Reader
+	fs *FS
 	// nil for the root directory, which has no entry in the zip
 	file *zip.File
+	n    *treeNode
+
+	// the mount root serves whatever tree is current, not n.
+	isRoot bool
+
+	layers nodeLayers
+}
+
+// tree returns the part of the index d serves. Other than the
+// root, a Dir keeps serving the archive it was looked up in after
+// a reload, like a directory that has been replaced on disk.
+func (d *Dir) tree() *treeNode {
+	if d.isRoot {
+		root, _ := d.fs.current()
+		return root
+	}
+	return d.n
 }
 
 var _ fs.Node = (*Dir)(nil)
@@ -247,99 +563,182 @@ func zipAttr(f *zip.File, a *fuse.Attr) {
 }
 
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
-	if d.file == nil {
-		// root directory
-		a.Mode = os.ModeDir | 0755
-		return nil
+	n := d.tree()
+	if n.file == nil {
+		// the root, or a directory the zip has no entry for
+		a.Mode = implicitDirMode
+		a.Mtime = n.mtime
+		a.Ctime = n.mtime
+		a.Crtime = n.mtime
+	} else {
+		zipAttr(n.file, a)
 	}
-	zipAttr(d.file, a)
+	d.fs.opts.applyAttr(a)
 	return nil
 }
 
 var _ = fs.NodeRequestLookuper(&Dir{})
 
 func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
-	path := req.Name
-	if d.file != nil {
-		path = d.file.Name + path
-	}
-	for _, f := range d.archive.File {
-		switch {
-		case f.Name == path:
-			child := &File{
-				file: f,
-			}
-			return child, nil
-		case f.Name[:len(f.Name)-1] == path && f.Name[len(f.Name)-1] == '/':
-			child := &Dir{
-				archive: d.archive,
-				file:    f,
-			}
-			return child, nil
-		}
+	if err := interrupted(ctx); err != nil {
+		return nil, err
+	}
+	n := d.tree()
+	child, ok := n.children[req.Name]
+	if !ok && n.folded != nil {
+		child, ok = n.folded[d.fs.opts.LookupFold.key(req.Name)]
+	}
+	if !ok {
+		return nil, fuse.ENOENT
 	}
-	return nil, fuse.ENOENT
+	if d.fs.opts.EntryValid != 0 {
+		resp.EntryValid = d.fs.opts.EntryValid
+	}
+	d.fs.holdNode(child.node)
+	return child.node, nil
+}
+
+var _ = fs.NodeForgetter(&Dir{})
+
+func (d *Dir) Forget() {
+	d.fs.forgetNode(&d.layers)
 }
 
 var _ = fs.HandleReadDirAller(&Dir{})
 
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	prefix := ""
-	if d.file != nil {
-		prefix = d.file.Name
-	}
-
-	var res []fuse.Dirent
-	for _, f := range d.archive.File {
-		if !strings.HasPrefix(f.Name, prefix) {
-			continue
-		}
-		name := f.Name[len(prefix):]
-		if name == "" {
-			// the dir itself, not a child
-			continue
-		}
-		if strings.ContainsRune(name[:len(name)-1], '/') {
-			// contains slash in the middle -> is in a deeper subdir
-			continue
-		}
-		var de fuse.Dirent
-		if name[len(name)-1] == '/' {
-			// directory
-			name = name[:len(name)-1]
-			de.Type = fuse.DT_Dir
-		}
-		de.Name = name
-		res = append(res, de)
+	n := d.tree()
+	res := make([]fuse.Dirent, 0, len(n.order))
+	for _, child := range n.order {
+		res = append(res, fuse.Dirent{
+			Name: child.name,
+			Type: child.direntType(),
+		})
 	}
 	return res, nil
 }
 
 type File struct {
+	fs   *FS
 	file *zip.File
+	path string // where file is in the tree; see CleanEntryName
+
+	layers nodeLayers
 }
 
 var _ fs.Node = (*File)(nil)
 
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	zipAttr(f.file, a)
+	f.fs.opts.applyAttr(a)
 	return nil
 }
 
 var _ = fs.NodeOpener(&File{})
 
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	fh, err := f.open(ctx, resp)
+	if err != nil {
+		return nil, err
+	}
+	// the handle keeps the layer open, even if a reload retires it.
+	fh.fs, fh.layers = f.fs, f.layers.files
+	f.fs.holdLayers(fh.layers)
+	return fh, nil
+}
+
+var _ = fs.NodeForgetter(&File{})
+
+func (f *File) Forget() {
+	f.fs.forgetNode(&f.layers)
+}
+
+func (f *File) open(ctx context.Context, resp *fuse.OpenResponse) (*FileHandle, error) {
+	if err := interrupted(ctx); err != nil {
+		return nil, err
+	}
+	if f.fs.opts.KeepCache {
+		resp.Flags |= fuse.OpenKeepCache
+	}
+	switch {
+	case isStored(f.file):
+		// stored entries are just a byte range of the zipfile, so
+		// we can serve them at any offset.
+		ra, err := f.fs.compressedData(f.file)
+		if err != nil {
+			return nil, err
+		}
+		return &FileHandle{ra: ra}, nil
+
+	case f.fs.cacheable(f.file):
+		data, err := f.fs.cachedContents(ctx, f.file)
+		if err != nil {
+			return nil, err
+		}
+		return &FileHandle{ra: bytes.NewReader(data)}, nil
+	}
+
+	fd, err := f.fs.diskCached(ctx, f.file)
+	if err != nil {
+		return nil, err
+	}
+	if fd != nil {
+		return &FileHandle{ra: fd}, nil
+	}
+
+	switch {
+	case f.file.Method == zip.Deflate && !isEncrypted(f.file):
+		// deflated entries are seekable via their seek index.
+		ra, err := newDeflateReaderAt(f.fs, f.file)
+		if err != nil {
+			return nil, err
+		}
+		return &FileHandle{ra: ra}, nil
+
+	case isEncrypted(f.file):
+		r, err := f.fs.openEncrypted(ctx, f.file)
+		if err != nil {
+			return nil, err
+		}
+		resp.Flags |= fuse.OpenNonSeekable
+		return &FileHandle{r: r}, nil
+	}
+
 	r, err := f.file.Open()
 	if err != nil {
 		return nil, err
 	}
-	// individual entries inside a zip file are not seekable
+	// entries in any other format can only be streamed
 	resp.Flags |= fuse.OpenNonSeekable
 	return &FileHandle{r: r}, nil
 }
 
+func isEncrypted(f *zip.File) bool {
+	const encryptedFlag = 0x1
+	return f.Flags&encryptedFlag != 0
+}
+
+// isStored reports whether the bytes of f sit in the zipfile
+// as-is: not compressed, and not encrypted.
+func isStored(f *zip.File) bool {
+	return f.Method == zip.Store && !isEncrypted(f) &&
+		f.CompressedSize64 == f.UncompressedSize64
+}
+
+// FileHandle serves reads either from r, a stream that must be
+// read in order, or from ra, which can be read at any offset.
 type FileHandle struct {
-	r io.ReadCloser
+	r  io.ReadCloser
+	ra io.ReaderAt
+
+	// mut serializes reads of r, and held keeps what an interrupted
+	// read had already taken from it, for the read that follows.
+	mut  sync.Mutex
+	held []byte
+
+	// the layers we read from, released along with the handle.
+	fs     *FS
+	layers []*layerFile
 }
 
 var _ fs.Handle = (*FileHandle)(nil)
@@ -347,12 +746,45 @@ var _ fs.Handle = (*FileHandle)(nil)
 var _ fs.HandleReleaser = (*FileHandle)(nil)
 
 func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if fh.fs != nil {
+		defer fh.fs.dropLayers(fh.layers)
+	}
+	if c, ok := fh.ra.(io.Closer); ok {
+		return c.Close()
+	}
+	if fh.r == nil {
+		return nil
+	}
 	return fh.r.Close()
 }
 
+// reader reads what fh serves from the start, all size bytes of it.
+func (fh *FileHandle) reader(size int64) io.Reader {
+	if fh.ra != nil {
+		return io.NewSectionReader(fh.ra, 0, size)
+	}
+	return fh.r
+}
+
 var _ = fs.HandleReader(&FileHandle{})
 
 func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if fh.ra != nil {
+		buf := make([]byte, req.Size)
+		var n int
+		var err error
+		if c, ok := fh.ra.(ctxReaderAt); ok {
+			n, err = c.readAtCtx(ctx, buf, req.Offset)
+		} else {
+			n, err = fh.ra.ReadAt(buf, req.Offset)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		resp.Data = buf[:n]
+		return err
+	}
+
 	// We don't actually enforce Offset to match where previous read
 	// ended. Maybe we should, but that would mean'd we need to track
 	// it. The kernel *should* do it for us, based on the
@@ -361,8 +793,19 @@ func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fus
 	// One exception to the above is if we fail to fully populate a
 	// page cache page; a read into page cache is always page aligned.
 	// Make sure we never serve a partial read, to avoid that.
+	fh.mut.Lock()
+	defer fh.mut.Unlock()
 	buf := make([]byte, req.Size)
-	n, err := io.ReadFull(fh.r, buf)
+	n := copy(buf, fh.held)
+	fh.held = fh.held[n:]
+	m, err := io.ReadFull(&ctxReader{ctx, fh.r}, buf[n:])
+	n += m
+	if err == errInterrupted {
+		// the kernel gives up on this read, but the bytes we took
+		// from the stream belong to the next one.
+		fh.held = buf[:n]
+		return err
+	}
 	if err == io.ErrUnexpectedEOF || err == io.EOF {
 		err = nil
 	}
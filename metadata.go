@@ -0,0 +1,122 @@
+package libzipfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The metadata region of a v2 footer holds, for each key in sorted
+// order,
+//
+//	[uint16 key length][key][uint32 value length][value]
+//
+// big-endian like the FooterTrailer, and then the checksum of all of
+// that, by the footer's HashAlgorithm, unpadded. The trailer's
+// MetadataLengthBytes gives the length of the whole region.
+
+// encodeMetadata lays out m as the metadata region of a v2 footer.
+func encodeMetadata(m map[string][]byte, alg HashAlgorithm) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		v := m[k]
+		if len(k) == 0 || len(k) > math.MaxUint16 {
+			return nil, fmt.Errorf("metadata key '%s' must be 1 to %d bytes long", k, math.MaxUint16)
+		}
+		if int64(len(v)) > math.MaxUint32 {
+			return nil, fmt.Errorf("metadata value for key '%s' is too long (%d bytes)", k, len(v))
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(len(k)))
+		buf.WriteString(k)
+		binary.Write(&buf, binary.BigEndian, uint32(len(v)))
+		buf.Write(v)
+	}
+	h := alg.New()
+	if h == nil {
+		return nil, fmt.Errorf("unknown hash algorithm %s", alg)
+	}
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+	return buf.Bytes(), nil
+}
+
+// decodeMetadata reads a metadata region written by encodeMetadata,
+// checking its checksum.
+func decodeMetadata(region []byte, alg HashAlgorithm) (map[string][]byte, error) {
+	h := alg.New()
+	if h == nil {
+		return nil, fmt.Errorf("unknown hash algorithm %s", alg)
+	}
+	if len(region) < h.Size() {
+		return nil, fmt.Errorf("footer metadata region too short (%d bytes)", len(region))
+	}
+	body, sum := region[:len(region)-h.Size()], region[len(region)-h.Size():]
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return nil, fmt.Errorf("footer metadata region does not have the expected checksum, file corrupt?")
+	}
+
+	m := make(map[string][]byte)
+	for len(body) > 0 {
+		if len(body) < 2 {
+			return nil, fmt.Errorf("footer metadata truncated in a key length")
+		}
+		klen := int(binary.BigEndian.Uint16(body))
+		body = body[2:]
+		if len(body) < klen+4 {
+			return nil, fmt.Errorf("footer metadata truncated in a key")
+		}
+		k := string(body[:klen])
+		vlen := int64(binary.BigEndian.Uint32(body[klen:]))
+		body = body[klen+4:]
+		if int64(len(body)) < vlen {
+			return nil, fmt.Errorf("footer metadata truncated in the value for key '%s'", k)
+		}
+		if _, dup := m[k]; dup {
+			return nil, fmt.Errorf("footer metadata has key '%s' twice", k)
+		}
+		m[k] = body[:vlen:vlen]
+		body = body[vlen:]
+	}
+	return m, nil
+}
+
+// MetadataBytes gives the metadata region of a v2 footer, which
+// goes just before its FooterTrailer; nil for a v00 footer.
+func (foot *Footer) MetadataBytes() []byte {
+	if !foot.IsV2() {
+		return nil
+	}
+	region, err := encodeMetadata(foot.Metadata, foot.HashAlgorithm)
+	panicOn(err) // FillHashes or decodeMetadata already vetted it
+	return region
+}
+
+// Meta returns the footer metadata value for key.
+func (foot *Footer) Meta(key string) ([]byte, bool) {
+	v, ok := foot.Metadata[key]
+	return v, ok
+}
+
+// Metadata returns the value recorded for key in the footer of the
+// combo file being served, as given to the combiner with -meta
+// key=value (or CombinerConfig.Metadata). It reports false if there
+// is no such key, or we aren't serving a combo file.
+func (p *FuseZipFs) Metadata(key string) ([]byte, bool) {
+	if p.filesys == nil {
+		return nil, false
+	}
+	_, foot := p.filesys.current()
+	if foot == nil {
+		return nil, false
+	}
+	return foot.Meta(key)
+}
@@ -0,0 +1,88 @@
+package libzipfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test025FooterV2CarriesMetadata(t *testing.T) {
+
+	cv.Convey("a combo made with metadata should get a v2 footer that reads back, splits, and catches corruption, while v00 combos read as before", t, func() {
+		out, err := ioutil.TempFile("", "libzipfs.test.")
+		panicOn(err)
+		out.Close()
+		os.Remove(out.Name())
+		defer os.Remove(out.Name())
+
+		cfg := CombinerConfig{
+			ExecutablePath: "testfiles/tester",
+			ZipfilePath:    "testfiles/hi.zip",
+			OutputPath:     out.Name(),
+			Metadata: map[string][]byte{
+				"build":  []byte("v1.2.3"),
+				"format": []byte("R-packages"),
+				"empty":  {},
+			},
+		}
+		panicOn(DoCombineExeAndZip(&cfg))
+
+		start, foot, comb, err := ReadFooter(out.Name())
+		cv.So(err, cv.ShouldBeNil)
+		comb.Close()
+		cv.So(foot.IsV2(), cv.ShouldBeTrue)
+		cv.So(start, cv.ShouldEqual, foot.ExecutableLengthBytes+foot.ZipfileLengthBytes)
+		cv.So(foot.FooterLengthBytes, cv.ShouldEqual, LIBZIPFS_FOOTER_LEN+foot.MetadataLengthBytes)
+		v, ok := foot.Meta("format")
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(string(v), cv.ShouldEqual, "R-packages")
+		v, ok = foot.Meta("empty")
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(len(v), cv.ShouldEqual, 0)
+		_, ok = foot.Meta("missing")
+		cv.So(ok, cv.ShouldBeFalse)
+
+		fzfs := &FuseZipFs{filesys: &FS{footer: foot}}
+		v, ok = fzfs.Metadata("build")
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(string(v), cv.ShouldEqual, "v1.2.3")
+
+		// the mount finds the zip between the exe and the footer.
+		layer := ZipLayer{ZipfilePath: out.Name(), ByteOffsetToZipFileStart: foot.ExecutableLengthBytes, FooterBytes: foot.FooterLengthBytes}
+		fd, _, err := layer.open()
+		cv.So(err, cv.ShouldBeNil)
+		fd.Close()
+
+		split := cfg
+		split.Split = true
+		dir, err := ioutil.TempDir("", "libzipfs.test.")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		split.ExecutablePath = dir + "/exe"
+		split.ZipfilePath = dir + "/zip"
+		_, err = DoSplitOutExeAndZip(&split)
+		cv.So(err, cv.ShouldBeNil)
+
+		whole := append(foot.MetadataBytes(), foot.ToBytes()...)
+		_, err = ReifyFooterAndDoInexpensiveChecks(whole, out.Name(), start)
+		cv.So(err, cv.ShouldBeNil)
+		for i := range whole {
+			whole[i]++
+			_, err = ReifyFooterAndDoInexpensiveChecks(whole, out.Name(), start)
+			cv.So(err, cv.ShouldNotBeNil)
+			whole[i]--
+		}
+		// the trailer alone isn't enough.
+		_, err = ReifyFooterAndDoInexpensiveChecks(foot.ToBytes(), out.Name(), start)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		_, old, comb, err := ReadFooter("testfiles/expectedCombined")
+		cv.So(err, cv.ShouldBeNil)
+		comb.Close()
+		cv.So(old.IsV2(), cv.ShouldBeFalse)
+		cv.So(old.Metadata, cv.ShouldBeNil)
+		cv.So(old.MetadataBytes(), cv.ShouldBeNil)
+	})
+}
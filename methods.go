@@ -0,0 +1,106 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"compress/bzip2"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression methods beyond archive/zip's Store and Deflate that
+// we know how to serve: `zip -Z bzip2` makes bzip2 entries, and
+// 7-Zip can make zstd and xz ones.
+const (
+	methodBzip2 = 12
+	methodZstd  = 93
+	methodXz    = 95
+)
+
+var extraDecompressors = map[uint16]zip.Decompressor{
+	methodBzip2: func(r io.Reader) io.ReadCloser {
+		return ioutil.NopCloser(bzip2.NewReader(r))
+	},
+	methodZstd: func(r io.Reader) io.ReadCloser {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return errReader{err}
+		}
+		return d.IOReadCloser()
+	},
+	methodXz: func(r io.Reader) io.ReadCloser {
+		x, err := xz.NewReader(r)
+		if err != nil {
+			return errReader{err}
+		}
+		return ioutil.NopCloser(x)
+	},
+}
+
+// errReader fails every read, for decompressors that can't start.
+type errReader struct{ err error }
+
+func (e errReader) Read(p []byte) (int, error) { return 0, e.err }
+func (e errReader) Close() error               { return nil }
+
+// registerDecompressors lets r open entries in the extra methods.
+// Every zip.Reader we make should go through here.
+func registerDecompressors(r *zip.Reader) {
+	for m, d := range extraDecompressors {
+		r.RegisterDecompressor(m, d)
+	}
+}
+
+// decompressor returns a reader of the data r holds compressed by
+// method, for the entries we decompress ourselves.
+func decompressor(method uint16, r io.Reader) (io.ReadCloser, error) {
+	switch method {
+	case zip.Store:
+		return ioutil.NopCloser(r), nil
+	case zip.Deflate:
+		return flate.NewReader(r), nil
+	}
+	if d, ok := extraDecompressors[method]; ok {
+		return d(r), nil
+	}
+	return nil, fmt.Errorf("unsupported compression method %d", method)
+}
+
+// canServeMethod reports whether we can decompress entries stored
+// with method.
+func canServeMethod(method uint16) bool {
+	_, ok := extraDecompressors[method]
+	return ok || method == zip.Store || method == zip.Deflate
+}
+
+// CheckZipMethods lists the entries of the zip file at path that a
+// mount won't be able to read, because we don't know their
+// compression method.
+func CheckZipMethods(path string) ([]string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	registerDecompressors(&r.Reader)
+	var bad []string
+	for _, f := range r.File {
+		method := f.Method
+		if method == winzipAESMethod {
+			ae, err := parseWinzipAES(f.Extra)
+			if err != nil {
+				bad = append(bad, fmt.Sprintf("'%s': %s", f.Name, err))
+				continue
+			}
+			method = ae.method
+		}
+		if !canServeMethod(method) {
+			bad = append(bad, fmt.Sprintf("'%s': unsupported compression method %d", f.Name, method))
+		}
+	}
+	return bad, nil
+}
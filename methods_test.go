@@ -0,0 +1,91 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/net/context"
+)
+
+// "hello from bzip2\n", as made by bzip2 -9.
+const bzip2Hello = "425a683931415926535955e9afe5000003d9800010400010001366d0102000229a3269e91fa840000d2af426e0bf2c0162ee48a70a120abd35fca0"
+
+// addRawEntry writes plain to zw as an entry already compressed,
+// by method, into comp.
+func addRawEntry(zw *zip.Writer, name string, method uint16, plain, comp []byte) {
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             method,
+		CRC32:              crc32.ChecksumIEEE(plain),
+		CompressedSize64:   uint64(len(comp)),
+		UncompressedSize64: uint64(len(plain)),
+	})
+	panicOn(err)
+	w.Write(comp)
+}
+
+func Test021Bzip2ZstdAndXzEntriesCanBeRead(t *testing.T) {
+
+	cv.Convey("entries compressed with bzip2, zstd and xz should read back, and the combiner should warn about methods we can't serve", t, func() {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		zw.RegisterCompressor(methodZstd, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		})
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: "zstd", Method: methodZstd})
+		panicOn(err)
+		w.Write([]byte("hello from zstd\n"))
+
+		// xz.NewWriter writes its stream header straight away, ahead
+		// of the zip local header, so compress the xz entry up front.
+		var xzBuf bytes.Buffer
+		xw, err := xz.NewWriter(&xzBuf)
+		panicOn(err)
+		xw.Write([]byte("hello from xz\n"))
+		panicOn(xw.Close())
+		bz, _ := hex.DecodeString(bzip2Hello)
+		addRawEntry(zw, "bzip2", methodBzip2, []byte("hello from bzip2\n"), bz)
+		addRawEntry(zw, "xz", methodXz, []byte("hello from xz\n"), xzBuf.Bytes())
+		w, err = zw.CreateRaw(&zip.FileHeader{Name: "lzma", Method: 14})
+		panicOn(err)
+		panicOn(zw.Close())
+
+		zf, err := ioutil.TempFile("", "libzipfs.methods.zip.")
+		panicOn(err)
+		defer os.Remove(zf.Name())
+		zf.Write(buf.Bytes())
+		zf.Close()
+
+		fd, layer, err := (&ZipLayer{ZipfilePath: zf.Name()}).open()
+		panicOn(err)
+		defer fd.Close()
+		fsys := &FS{layers: []archiveLayer{layer}}
+		fsys.root = buildTree(fsys)
+
+		ctx := context.Background()
+		for _, name := range []string{"bzip2", "zstd", "xz"} {
+			node, err := lookupPath(fsys, name)
+			panicOn(err)
+			h, err := node.(*File).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+			cv.So(err, cv.ShouldBeNil)
+			resp := &fuse.ReadResponse{}
+			cv.So(h.(*FileHandle).Read(ctx, &fuse.ReadRequest{Size: 100}, resp), cv.ShouldBeNil)
+			cv.So(string(resp.Data), cv.ShouldEqual, "hello from "+name+"\n")
+			h.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{})
+		}
+
+		bad, err := CheckZipMethods(zf.Name())
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(bad, cv.ShouldResemble, []string{"'lzma': unsupported compression method 14"})
+	})
+}
@@ -0,0 +1,92 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// UnsafeName reports a zip entry whose name can't be served as a
+// path inside the mount; see CleanEntryName.
+type UnsafeName struct {
+	Name   string // as it appears in the zip
+	Reason string
+}
+
+func (u UnsafeName) String() string {
+	return fmt.Sprintf("%q: %s", u.Name, u.Reason)
+}
+
+// CleanEntryName turns the name of a zip entry into the relative,
+// slash-separated path we serve it at, much as unzip does:
+// backslashes are taken as separators, and leading slashes and empty
+// or "." components are dropped. A trailing slash, marking a
+// directory, is kept. Names with NUL bytes or ".." components can't
+// be made safe, since they could name something outside the tree,
+// and give an error.
+func CleanEntryName(name string) (string, error) {
+	if strings.IndexByte(name, 0) >= 0 {
+		return "", fmt.Errorf("name contains a NUL byte")
+	}
+	slashed := strings.Replace(name, `\`, "/", -1)
+	var parts []string
+	for _, p := range strings.Split(slashed, "/") {
+		switch p {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("name has a '..' component")
+		}
+		parts = append(parts, p)
+	}
+	clean := strings.Join(parts, "/")
+	if clean != "" && strings.HasSuffix(slashed, "/") {
+		clean += "/"
+	}
+	return clean, nil
+}
+
+// quarantineDir checks QuarantineDir, returning it as a relative zip
+// path with no trailing slash; "" if it isn't set.
+func (o *MountOptions) quarantineDir() (string, error) {
+	if o.QuarantineDir == "" {
+		return "", nil
+	}
+	dir, err := CleanEntryName(o.QuarantineDir)
+	if err == nil && (dir == "" || strings.HasPrefix(o.QuarantineDir, "/") || strings.HasPrefix(o.QuarantineDir, `\`)) {
+		err = fmt.Errorf("must be a relative path below the mount root")
+	}
+	if err != nil {
+		return "", fmt.Errorf("QuarantineDir '%s': %s", o.QuarantineDir, err)
+	}
+	return strings.TrimSuffix(dir, "/"), nil
+}
+
+// quarantineName is the name an unsafe entry gets in the
+// MountOptions.QuarantineDir directory: all of it, escaped so as to
+// be a single harmless path component.
+func quarantineName(name string) string {
+	esc := url.PathEscape(name)
+	if strings.HasPrefix(esc, ".") {
+		esc = "%2E" + esc[1:]
+	}
+	return esc
+}
+
+// CheckZipNames lists the entries of the zip file at path that
+// CleanEntryName finds unsafe.
+func CheckZipNames(path string) ([]UnsafeName, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var unsafe []UnsafeName
+	for _, f := range r.File {
+		if _, err := CleanEntryName(f.Name); err != nil {
+			unsafe = append(unsafe, UnsafeName{Name: f.Name, Reason: err.Error()})
+		}
+	}
+	return unsafe, nil
+}
@@ -0,0 +1,90 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test018HostileEntryNamesAreCleanedOrLeftOut(t *testing.T) {
+
+	cv.Convey("entry names should be cleaned into relative paths, and those that could escape the tree left out or quarantined", t, func() {
+		for name, want := range map[string]string{
+			"a//b":       "a/b",
+			"/abs/path":  "abs/path",
+			`win\dir\f`:  "win/dir/f",
+			"./x/./y/":   "x/y/",
+			"dir/":       "dir/",
+			"plain.txt":  "plain.txt",
+			"a/b..c/..d": "a/b..c/..d",
+		} {
+			clean, err := CleanEntryName(name)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(clean, cv.ShouldEqual, want)
+		}
+		for _, name := range []string{"../../etc/x", `..\evil`, "a/../b", "nul\x00byte"} {
+			_, err := CleanEntryName(name)
+			cv.So(err, cv.ShouldNotBeNil)
+		}
+
+		fsys := testArchive("a//b", "/abs/path", "../../etc/x", "ok")
+		cv.So(fsys.buildIndex(), cv.ShouldBeNil)
+		_, err := lookupPath(fsys, "a", "b")
+		cv.So(err, cv.ShouldBeNil)
+		p, err := lookupPath(fsys, "abs", "path")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(p.(*File).path, cv.ShouldEqual, "abs/path")
+		_, err = lookupPath(fsys, "etc", "x")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(len(fsys.unsafe), cv.ShouldEqual, 1)
+		cv.So(fsys.unsafe[0].Name, cv.ShouldEqual, "../../etc/x")
+
+		fsys.opts.QuarantineDir = "_unsafe"
+		cv.So(fsys.buildIndex(), cv.ShouldBeNil)
+		q, err := lookupPath(fsys, "_unsafe", "%2E.%2F..%2Fetc%2Fx")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(q.(*File).file.Name, cv.ShouldEqual, "../../etc/x")
+
+		// Start() won't quarantine anywhere outside the mount.
+		for _, bad := range []string{"..", "q/../..", "/abs", "/", "./"} {
+			p := NewFuseZipFs("testfiles/hi.zip", "/nonexistent", 0, 0, 0)
+			p.QuarantineDir = bad
+			err = p.Start()
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "QuarantineDir")
+		}
+		opts := MountOptions{QuarantineDir: "./_unsafe/"}
+		q, err = opts.quarantineDir()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(q, cv.ShouldEqual, "_unsafe")
+	})
+
+	cv.Convey("the combiner should refuse a zip with unsafe names unless told otherwise", t, func() {
+		zf, err := ioutil.TempFile("", "libzipfs.unsafe.zip.")
+		panicOn(err)
+		defer os.Remove(zf.Name())
+		zw := zip.NewWriter(zf)
+		_, err = zw.Create("../../etc/cron.d/evil")
+		panicOn(err)
+		panicOn(zw.Close())
+		zf.Close()
+
+		unsafe, err := CheckZipNames(zf.Name())
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(unsafe), cv.ShouldEqual, 1)
+
+		out, err := ioutil.TempDir("", "libzipfs.unsafe.out.")
+		panicOn(err)
+		defer os.RemoveAll(out)
+		cfg := &CombinerConfig{ExecutablePath: "testfiles/tester", ZipfilePath: zf.Name(), OutputPath: out + "/combo"}
+		cv.So(DoCombineExeAndZip(cfg), cv.ShouldNotBeNil)
+		cv.So(FileExists(cfg.OutputPath), cv.ShouldBeFalse)
+
+		cfg.AllowUnsafeNames = true
+		cv.So(DoCombineExeAndZip(cfg), cv.ShouldBeNil)
+		cv.So(FileExists(cfg.OutputPath), cv.ShouldBeTrue)
+	})
+}
@@ -0,0 +1,705 @@
+package libzipfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// overlay is the writable upper layer laid over the zip when
+// MountOptions.Writable is set. Everything written lands in dir, a
+// plain directory mirroring the layout of the mount; files from the
+// zip are copied up into it the first time they are changed.
+// Deleting something that lives in the zip leaves a ".wh.<name>"
+// whiteout file where it would be, the same convention aufs and
+// container image layers use, and a directory re-made over a deleted
+// one is marked opaque so the zip's old contents stay hidden.
+type overlay struct {
+	fs  *FS
+	dir string
+
+	// mut serializes lookups and changes to the namespace.
+	mut   sync.Mutex
+	nodes map[string]fs.Node // by path, so the kernel sees stable nodes
+}
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueMarker   = ".wh..wh..opq"
+)
+
+func newOverlay(fsys *FS, dir string) *overlay {
+	return &overlay{fs: fsys, dir: dir, nodes: make(map[string]fs.Node)}
+}
+
+func (ov *overlay) upper(p string) string {
+	return filepath.Join(ov.dir, filepath.FromSlash(p))
+}
+
+func (ov *overlay) whiteout(p string) string {
+	dir, base := splitEntryPath(p)
+	return filepath.Join(ov.upper(dir), whiteoutPrefix+base)
+}
+
+func isWhiteoutName(name string) bool {
+	return strings.HasPrefix(name, whiteoutPrefix)
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// node returns the fs.Node for path p, reusing the one handed out
+// before if it is still of the right kind.
+func (ov *overlay) node(p string, isDir bool) fs.Node {
+	if n, ok := ov.nodes[p]; ok {
+		if _, wasDir := n.(*ovDir); wasDir == isDir {
+			return n
+		}
+	}
+	var n fs.Node
+	if isDir {
+		n = &ovDir{ov: ov, path: p}
+	} else {
+		n = &ovFile{ov: ov, path: p}
+	}
+	ov.nodes[p] = n
+	return n
+}
+
+// lower returns the zip's entry for p, unless the upper layer hides
+// it with a whiteout or an opaque directory somewhere along the way.
+func (ov *overlay) lower(p string) *treeNode {
+	n, _ := ov.fs.current()
+	if p == "" {
+		return n
+	}
+	sofar := ""
+	for _, name := range strings.Split(p, "/") {
+		if exists(filepath.Join(ov.upper(sofar), opaqueMarker)) {
+			return nil
+		}
+		c, ok := n.children[name]
+		if !ok {
+			return nil
+		}
+		sofar = joinPath(sofar, name)
+		if exists(ov.whiteout(sofar)) {
+			return nil
+		}
+		n = c
+	}
+	return n
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// resolve finds what is at p: the upper copy if there is one, else
+// the zip entry.
+func (ov *overlay) resolve(p string) (os.FileInfo, *treeNode) {
+	if fi, err := os.Lstat(ov.upper(p)); err == nil {
+		return fi, nil
+	}
+	return nil, ov.lower(p)
+}
+
+// copyUpDir makes sure the directory p exists in the upper layer.
+func (ov *overlay) copyUpDir(p string) error {
+	fi, err := os.Lstat(ov.upper(p))
+	if err == nil {
+		if !fi.IsDir() {
+			return fuse.Errno(syscall.ENOTDIR)
+		}
+		return nil
+	}
+	if p != "" {
+		parent, _ := splitEntryPath(p)
+		if err := ov.copyUpDir(parent); err != nil {
+			return err
+		}
+	}
+	mode := os.FileMode(0755)
+	if ln := ov.lower(p); ln != nil && ln.file != nil {
+		mode = ln.file.Mode().Perm() | 0700
+	}
+	return os.Mkdir(ov.upper(p), mode)
+}
+
+// copyUp copies the zip's file at p into the upper layer, so that
+// it can be changed. A copy interrupted via ctx is thrown away.
+func (ov *overlay) copyUp(ctx context.Context, p string) error {
+	if exists(ov.upper(p)) {
+		return nil
+	}
+	ln := ov.lower(p)
+	if ln == nil {
+		return fuse.ENOENT
+	}
+	parent, _ := splitEntryPath(p)
+	if err := ov.copyUpDir(parent); err != nil {
+		return err
+	}
+
+	// read it the way a read through the mount would, so that
+	// encrypted entries are decrypted, and the caches used.
+	h, err := ln.node.(fs.NodeOpener).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		return err
+	}
+	fh := h.(*FileHandle)
+	defer fh.Release(ctx, &fuse.ReleaseRequest{})
+	r := fh.reader(int64(ln.file.UncompressedSize64))
+
+	if isSymlink(ln) {
+		target, err := ioutil.ReadAll(io.LimitReader(r, maxSymlinkTarget))
+		if err != nil {
+			return err
+		}
+		return os.Symlink(string(target), ov.upper(p))
+	}
+
+	tmp, err := ioutil.TempFile(ov.upper(parent), ".libzipfs-copyup-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, &ctxReader{ctx, r})
+	if err == nil {
+		err = tmp.Chmod(ln.file.Mode().Perm() | 0200)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), ln.file.ModTime(), ln.file.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), ov.upper(p))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	VPrintf("overlay: copied '%s' up to '%s'\n", p, ov.upper(p))
+	return nil
+}
+
+// entries lists the merged contents of directory p.
+func (ov *overlay) entries(p string) []fuse.Dirent {
+	seen := make(map[string]bool)
+	var res []fuse.Dirent
+
+	fis, _ := ioutil.ReadDir(ov.upper(p))
+	for _, fi := range fis {
+		if isWhiteoutName(fi.Name()) {
+			continue
+		}
+		seen[fi.Name()] = true
+		res = append(res, fuse.Dirent{Name: fi.Name(), Type: modeDirentType(fi.Mode())})
+	}
+	if ln := ov.lower(p); ln != nil && !exists(filepath.Join(ov.upper(p), opaqueMarker)) {
+		for _, c := range ln.order {
+			if seen[c.name] || exists(ov.whiteout(joinPath(p, c.name))) {
+				continue
+			}
+			res = append(res, fuse.Dirent{Name: c.name, Type: c.direntType()})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func modeDirentType(m os.FileMode) fuse.DirentType {
+	switch {
+	case m.IsDir():
+		return fuse.DT_Dir
+	case m&os.ModeSymlink != 0:
+		return fuse.DT_Link
+	}
+	return fuse.DT_File
+}
+
+// rename moves the cached nodes at and below oldp over to newp.
+func (ov *overlay) rename(oldp, newp string) {
+	for p, n := range ov.nodes {
+		if p != oldp && !strings.HasPrefix(p, oldp+"/") {
+			continue
+		}
+		delete(ov.nodes, p)
+		moved := newp + p[len(oldp):]
+		switch n := n.(type) {
+		case *ovDir:
+			n.path = moved
+		case *ovFile:
+			n.path = moved
+		}
+		ov.nodes[moved] = n
+	}
+}
+
+// fileInfoAttr describes an upper layer file, adjusted by the mount
+// options just as the zip entries are. As with lowerAttr, the kernel
+// only gets the default cache time.
+func (ov *overlay) fileInfoAttr(fi os.FileInfo, a *fuse.Attr) {
+	a.Size = uint64(fi.Size())
+	a.Mode = fi.Mode()
+	a.Mtime = fi.ModTime()
+	a.Ctime = fi.ModTime()
+	a.Crtime = fi.ModTime()
+	valid := a.Valid
+	ov.fs.opts.applyAttr(a)
+	a.Valid = valid
+}
+
+// lowerAttr describes a zip entry seen through the overlay. Anything
+// in the mount may change, so the kernel only gets the default
+// cache time, not MountOptions.AttrValid.
+func lowerAttr(ctx context.Context, ln *treeNode, a *fuse.Attr) error {
+	valid := a.Valid
+	err := ln.node.Attr(ctx, a)
+	a.Valid = valid
+	return err
+}
+
+// toFuseErr passes the errno from a failed os call back to the kernel.
+func toFuseErr(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case fuse.ErrorNumber:
+		return err
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return fuse.Errno(errno)
+	}
+	return err
+}
+
+// ovDir is a directory in a writable mount.
+type ovDir struct {
+	ov   *overlay
+	path string
+}
+
+var _ fs.Node = (*ovDir)(nil)
+
+func (d *ovDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	if d.path == "" {
+		// the root looks as it does on a read-only mount, whatever
+		// the mode of the overlay directory itself.
+		root, _ := d.ov.fs.current()
+		return lowerAttr(ctx, root, a)
+	}
+	d.ov.mut.Lock()
+	fi, ln := d.ov.resolve(d.path)
+	d.ov.mut.Unlock()
+	switch {
+	case fi != nil:
+		d.ov.fileInfoAttr(fi, a)
+		return nil
+	case ln != nil:
+		return lowerAttr(ctx, ln, a)
+	}
+	return fuse.ENOENT
+}
+
+var _ = fs.NodeRequestLookuper(&ovDir{})
+
+func (d *ovDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	if err := interrupted(ctx); err != nil {
+		return nil, err
+	}
+	if isWhiteoutName(req.Name) {
+		return nil, fuse.ENOENT
+	}
+	d.ov.mut.Lock()
+	defer d.ov.mut.Unlock()
+	p := joinPath(d.path, req.Name)
+	fi, ln := d.ov.resolve(p)
+	switch {
+	case fi != nil:
+		return d.ov.node(p, fi.IsDir()), nil
+	case ln != nil:
+		return d.ov.node(p, ln.isDir), nil
+	}
+	return nil, fuse.ENOENT
+}
+
+var _ = fs.HandleReadDirAller(&ovDir{})
+
+func (d *ovDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	d.ov.mut.Lock()
+	defer d.ov.mut.Unlock()
+	return d.ov.entries(d.path), nil
+}
+
+var _ = fs.NodeCreater(&ovDir{})
+
+func (d *ovDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if isWhiteoutName(req.Name) {
+		return nil, nil, fuse.EPERM
+	}
+	d.ov.mut.Lock()
+	defer d.ov.mut.Unlock()
+	p := joinPath(d.path, req.Name)
+	if err := d.ov.copyUpDir(d.path); err != nil {
+		return nil, nil, toFuseErr(err)
+	}
+	flags := openFlags(req.Flags) | os.O_CREATE
+	if req.Flags&fuse.OpenExclusive != 0 {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(d.ov.upper(p), flags, req.Mode.Perm())
+	if err != nil {
+		return nil, nil, toFuseErr(err)
+	}
+	os.Remove(d.ov.whiteout(p))
+	return d.ov.node(p, false), &ovHandle{f: f}, nil
+}
+
+var _ = fs.NodeMkdirer(&ovDir{})
+
+func (d *ovDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if isWhiteoutName(req.Name) {
+		return nil, fuse.EPERM
+	}
+	d.ov.mut.Lock()
+	defer d.ov.mut.Unlock()
+	p := joinPath(d.path, req.Name)
+	if fi, ln := d.ov.resolve(p); fi != nil || ln != nil {
+		return nil, fuse.EEXIST
+	}
+	if err := d.ov.copyUpDir(d.path); err != nil {
+		return nil, toFuseErr(err)
+	}
+	if err := os.Mkdir(d.ov.upper(p), req.Mode.Perm()); err != nil {
+		return nil, toFuseErr(err)
+	}
+	if os.Remove(d.ov.whiteout(p)) == nil {
+		// something in the zip was deleted here; keep its contents hidden.
+		if err := ioutil.WriteFile(filepath.Join(d.ov.upper(p), opaqueMarker), nil, 0644); err != nil {
+			return nil, toFuseErr(err)
+		}
+	}
+	return d.ov.node(p, true), nil
+}
+
+var _ = fs.NodeSymlinker(&ovDir{})
+
+func (d *ovDir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if isWhiteoutName(req.NewName) {
+		return nil, fuse.EPERM
+	}
+	d.ov.mut.Lock()
+	defer d.ov.mut.Unlock()
+	p := joinPath(d.path, req.NewName)
+	if err := d.ov.copyUpDir(d.path); err != nil {
+		return nil, toFuseErr(err)
+	}
+	if err := os.Symlink(req.Target, d.ov.upper(p)); err != nil {
+		return nil, toFuseErr(err)
+	}
+	os.Remove(d.ov.whiteout(p))
+	return d.ov.node(p, false), nil
+}
+
+var _ = fs.NodeRemover(&ovDir{})
+
+func (d *ovDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	d.ov.mut.Lock()
+	defer d.ov.mut.Unlock()
+	p := joinPath(d.path, req.Name)
+	fi, ln := d.ov.resolve(p)
+	if fi == nil && ln == nil {
+		return fuse.ENOENT
+	}
+	if req.Dir {
+		if len(d.ov.entries(p)) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		// all that can be left in it are whiteouts.
+		if err := os.RemoveAll(d.ov.upper(p)); err != nil {
+			return toFuseErr(err)
+		}
+	} else if fi != nil {
+		if err := os.Remove(d.ov.upper(p)); err != nil {
+			return toFuseErr(err)
+		}
+	}
+	if d.ov.lower(p) != nil {
+		if err := d.ov.copyUpDir(d.path); err != nil {
+			return toFuseErr(err)
+		}
+		if err := ioutil.WriteFile(d.ov.whiteout(p), nil, 0644); err != nil {
+			return toFuseErr(err)
+		}
+	}
+	delete(d.ov.nodes, p)
+	return nil
+}
+
+var _ = fs.NodeRenamer(&ovDir{})
+
+func (d *ovDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	nd, ok := newDir.(*ovDir)
+	if !ok || isWhiteoutName(req.NewName) {
+		return fuse.EPERM
+	}
+	d.ov.mut.Lock()
+	defer d.ov.mut.Unlock()
+	oldp := joinPath(d.path, req.OldName)
+	newp := joinPath(nd.path, req.NewName)
+
+	fi, ln := d.ov.resolve(oldp)
+	if fi == nil && ln == nil {
+		return fuse.ENOENT
+	}
+	isDir := ln != nil && ln.isDir || fi != nil && fi.IsDir()
+	if nfi, nln := d.ov.resolve(newp); nfi != nil || nln != nil {
+		// as rename(2) would; above all, a file must not shadow a
+		// whole directory of the zip.
+		overDir := nln != nil && nln.isDir || nfi != nil && nfi.IsDir()
+		switch {
+		case overDir && !isDir:
+			return fuse.Errno(syscall.EISDIR)
+		case !overDir && isDir:
+			return fuse.Errno(syscall.ENOTDIR)
+		case overDir && len(d.ov.entries(newp)) > 0:
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+	inZip := d.ov.lower(oldp) != nil
+	if inZip && isDir {
+		// like overlayfs: we won't move a directory the zip has
+		// entries in; mv copes by copying and deleting instead.
+		return fuse.Errno(syscall.EXDEV)
+	}
+	if err := d.ov.copyUp(ctx, oldp); err != nil {
+		return toFuseErr(err)
+	}
+	if err := d.ov.copyUpDir(nd.path); err != nil {
+		return toFuseErr(err)
+	}
+	if err := os.Rename(d.ov.upper(oldp), d.ov.upper(newp)); err != nil {
+		return toFuseErr(err)
+	}
+	os.Remove(d.ov.whiteout(newp))
+	if inZip {
+		if err := ioutil.WriteFile(d.ov.whiteout(oldp), nil, 0644); err != nil {
+			return toFuseErr(err)
+		}
+	}
+	delete(d.ov.nodes, newp)
+	d.ov.rename(oldp, newp)
+	return nil
+}
+
+var _ = fs.NodeSetattrer(&ovDir{})
+
+func (d *ovDir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	d.ov.mut.Lock()
+	err := d.ov.copyUpDir(d.path)
+	if err == nil {
+		err = setattr(d.ov.upper(d.path), req)
+	}
+	d.ov.mut.Unlock()
+	if err != nil {
+		return toFuseErr(err)
+	}
+	return d.Attr(ctx, &resp.Attr)
+}
+
+// setattr applies the changes in req to the upper layer file at path.
+func setattr(path string, req *fuse.SetattrRequest) error {
+	if req.Valid.Size() {
+		if err := os.Truncate(path, int64(req.Size)); err != nil {
+			return err
+		}
+	}
+	if req.Valid.Mode() {
+		if err := os.Chmod(path, req.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if req.Valid.Mtime() || req.Valid.Atime() {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		atime, mtime := fi.ModTime(), fi.ModTime()
+		if req.Valid.Atime() {
+			atime = req.Atime
+		}
+		if req.Valid.Mtime() {
+			mtime = req.Mtime
+		}
+		if err := os.Chtimes(path, atime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ovFile is a file or symlink in a writable mount.
+type ovFile struct {
+	ov   *overlay
+	path string
+}
+
+var _ fs.Node = (*ovFile)(nil)
+
+func (f *ovFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.ov.mut.Lock()
+	fi, ln := f.ov.resolve(f.path)
+	f.ov.mut.Unlock()
+	switch {
+	case fi != nil:
+		f.ov.fileInfoAttr(fi, a)
+		return nil
+	case ln != nil:
+		return lowerAttr(ctx, ln, a)
+	}
+	return fuse.ENOENT
+}
+
+// openFlags picks out of fl the flags we pass on to os.OpenFile.
+// O_APPEND is left out: the kernel sends each write with the offset
+// it should go to.
+func openFlags(fl fuse.OpenFlags) int {
+	return int(fl & fuse.OpenAccessModeMask)
+}
+
+var _ = fs.NodeOpener(&ovFile{})
+
+func (f *ovFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	f.ov.mut.Lock()
+	upper := f.ov.upper(f.path)
+	fi, ln := f.ov.resolve(f.path)
+	inUpper := fi != nil
+	if !inUpper && ln != nil && !req.Flags.IsReadOnly() {
+		if err := f.ov.copyUp(ctx, f.path); err != nil {
+			f.ov.mut.Unlock()
+			return nil, toFuseErr(err)
+		}
+		inUpper = true
+	}
+	f.ov.mut.Unlock()
+
+	switch {
+	case inUpper:
+		fd, err := os.OpenFile(upper, openFlags(req.Flags), 0)
+		if err != nil {
+			return nil, toFuseErr(err)
+		}
+		return &ovHandle{f: fd}, nil
+	case ln != nil:
+		return ln.node.(fs.NodeOpener).Open(ctx, req, resp)
+	}
+	return nil, fuse.ENOENT
+}
+
+var _ = fs.NodeReadlinker(&ovFile{})
+
+func (f *ovFile) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	f.ov.mut.Lock()
+	upper := f.ov.upper(f.path)
+	fi, ln := f.ov.resolve(f.path)
+	f.ov.mut.Unlock()
+	switch {
+	case fi != nil:
+		target, err := os.Readlink(upper)
+		return target, toFuseErr(err)
+	case ln != nil:
+		return ln.node.(fs.NodeReadlinker).Readlink(ctx, req)
+	}
+	return "", fuse.ENOENT
+}
+
+var _ = fs.NodeSetattrer(&ovFile{})
+
+func (f *ovFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	f.ov.mut.Lock()
+	err := f.ov.copyUp(ctx, f.path)
+	if err == nil {
+		err = setattr(f.ov.upper(f.path), req)
+	}
+	f.ov.mut.Unlock()
+	if err != nil {
+		return toFuseErr(err)
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+var _ = fs.NodeFsyncer(&ovFile{})
+
+func (f *ovFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	f.ov.mut.Lock()
+	upper := f.ov.upper(f.path)
+	f.ov.mut.Unlock()
+	fd, err := os.Open(upper)
+	if os.IsNotExist(err) {
+		return nil // still only in the zip
+	}
+	if err != nil {
+		return toFuseErr(err)
+	}
+	defer fd.Close()
+	return toFuseErr(fd.Sync())
+}
+
+// ovHandle is an open file in the upper layer.
+type ovHandle struct {
+	f *os.File
+}
+
+var _ = fs.HandleReader(&ovHandle{})
+
+func (h *ovHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := h.f.ReadAt(buf, req.Offset)
+	if err == io.EOF {
+		err = nil
+	}
+	resp.Data = buf[:n]
+	return toFuseErr(err)
+}
+
+var _ = fs.HandleWriter(&ovHandle{})
+
+func (h *ovHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	n, err := h.f.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	return toFuseErr(err)
+}
+
+var _ = fs.HandleFlusher(&ovHandle{})
+
+func (h *ovHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return nil
+}
+
+var _ fs.HandleReleaser = (*ovHandle)(nil)
+
+func (h *ovHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return toFuseErr(h.f.Close())
+}
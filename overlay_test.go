@@ -0,0 +1,145 @@
+package libzipfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+func Test013WritableOverlayCopiesUpAndWhitesOut(t *testing.T) {
+
+	cv.Convey("a writable mount should keep new files in the overlay directory and hide deleted zip entries with whiteouts", t, func() {
+		dir, err := ioutil.TempDir("", "libzipfs-overlay-test")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+
+		fsys := testArchive("etc/hosts", "etc/passwd", "README")
+		fsys.overlay = newOverlay(fsys, dir)
+		ctx := context.Background()
+		root, err := fsys.Root()
+		panicOn(err)
+		rootDir := root.(*ovDir)
+
+		names := func(d *ovDir) []string {
+			ents, err := d.ReadDirAll(ctx)
+			panicOn(err)
+			var ns []string
+			for _, e := range ents {
+				ns = append(ns, e.Name)
+			}
+			return ns
+		}
+		cv.So(names(rootDir), cv.ShouldResemble, []string{"README", "etc"})
+
+		etc, err := rootDir.Lookup(ctx, &fuse.LookupRequest{Name: "etc"}, &fuse.LookupResponse{})
+		cv.So(err, cv.ShouldBeNil)
+		etcDir := etc.(*ovDir)
+
+		// create a new file under a directory that only the zip has.
+		_, h, err := etcDir.Create(ctx, &fuse.CreateRequest{Name: "motd", Flags: fuse.OpenReadWrite, Mode: 0644}, &fuse.CreateResponse{})
+		cv.So(err, cv.ShouldBeNil)
+		wresp := &fuse.WriteResponse{}
+		cv.So(h.(*ovHandle).Write(ctx, &fuse.WriteRequest{Data: []byte("hi\n")}, wresp), cv.ShouldBeNil)
+		cv.So(h.(*ovHandle).Release(ctx, &fuse.ReleaseRequest{}), cv.ShouldBeNil)
+		by, err := ioutil.ReadFile(filepath.Join(dir, "etc", "motd"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(by), cv.ShouldEqual, "hi\n")
+		cv.So(names(etcDir), cv.ShouldResemble, []string{"hosts", "motd", "passwd"})
+
+		// deleting a zip entry leaves a whiteout and hides it.
+		cv.So(etcDir.Remove(ctx, &fuse.RemoveRequest{Name: "passwd"}), cv.ShouldBeNil)
+		cv.So(exists(filepath.Join(dir, "etc", ".wh.passwd")), cv.ShouldBeTrue)
+		cv.So(names(etcDir), cv.ShouldResemble, []string{"hosts", "motd"})
+		_, err = etcDir.Lookup(ctx, &fuse.LookupRequest{Name: "passwd"}, &fuse.LookupResponse{})
+		cv.So(err, cv.ShouldEqual, fuse.ENOENT)
+
+		// renaming a zip file copies it up and whites out the old name.
+		cv.So(rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "README", NewName: "README.md"}, rootDir), cv.ShouldBeNil)
+		by, err = ioutil.ReadFile(filepath.Join(dir, "README.md"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(by), cv.ShouldEqual, "contents of README")
+		cv.So(names(rootDir), cv.ShouldResemble, []string{"README.md", "etc"})
+
+		// nor may a file replace a directory, or a directory a file.
+		err = rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "README.md", NewName: "etc"}, rootDir)
+		cv.So(err, cv.ShouldEqual, fuse.Errno(syscall.EISDIR))
+		_, err = rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "new", Mode: 0755})
+		panicOn(err)
+		err = rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "new", NewName: "hosts"}, etcDir)
+		cv.So(err, cv.ShouldEqual, fuse.Errno(syscall.ENOTDIR))
+		err = rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "new", NewName: "etc"}, rootDir)
+		cv.So(err, cv.ShouldEqual, fuse.Errno(syscall.ENOTEMPTY))
+		cv.So(rootDir.Remove(ctx, &fuse.RemoveRequest{Name: "new", Dir: true}), cv.ShouldBeNil)
+		cv.So(names(etcDir), cv.ShouldResemble, []string{"hosts", "motd"})
+
+		// directories from the zip can't be renamed.
+		err = rootDir.Rename(ctx, &fuse.RenameRequest{OldName: "etc", NewName: "etc2"}, rootDir)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		// a directory re-made over a deleted one starts out empty.
+		cv.So(etcDir.Remove(ctx, &fuse.RemoveRequest{Name: "motd"}), cv.ShouldBeNil)
+		cv.So(etcDir.Remove(ctx, &fuse.RemoveRequest{Name: "hosts"}), cv.ShouldBeNil)
+		cv.So(rootDir.Remove(ctx, &fuse.RemoveRequest{Name: "etc", Dir: true}), cv.ShouldBeNil)
+		cv.So(names(rootDir), cv.ShouldResemble, []string{"README.md"})
+		etc, err = rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "etc", Mode: 0755})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(names(etc.(*ovDir)), cv.ShouldBeEmpty)
+
+		// an overlay directory alone doesn't make a mount writable.
+		p := NewFuseZipFs("testfiles/hi.zip", dir, 0, 0, 0)
+		p.OverlayDir = dir
+		err = p.Start()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "Writable is not")
+	})
+}
+
+func Test032UpperLayerFilesGetTheMountOptions(t *testing.T) {
+
+	cv.Convey("files and directories in the overlay should get the same owner, mode, mask and setuid treatment as those in the zip", t, func() {
+		dir, err := ioutil.TempDir("", "libzipfs-overlay-test")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+
+		fsys := testArchive("etc/hosts")
+		fsys.opts = MountOptions{Uid: 1000, Gid: 100, FileMode: 0664, FileMask: 0004, DirMask: 0022, StripSetuid: true}
+		fsys.overlay = newOverlay(fsys, dir)
+		ctx := context.Background()
+		root, err := fsys.Root()
+		panicOn(err)
+		rootDir := root.(*ovDir)
+
+		_, h, err := rootDir.Create(ctx, &fuse.CreateRequest{Name: "run.sh", Flags: fuse.OpenReadWrite, Mode: 0755}, &fuse.CreateResponse{})
+		panicOn(err)
+		panicOn(h.(*ovHandle).Release(ctx, &fuse.ReleaseRequest{}))
+		panicOn(os.Chmod(filepath.Join(dir, "run.sh"), 0755|os.ModeSetuid))
+		sub, err := rootDir.Mkdir(ctx, &fuse.MkdirRequest{Name: "lib", Mode: 0777})
+		panicOn(err)
+		panicOn(os.Chmod(filepath.Join(dir, "lib"), 0777|os.ModeSetgid))
+
+		node, err := rootDir.Lookup(ctx, &fuse.LookupRequest{Name: "run.sh"}, &fuse.LookupResponse{})
+		panicOn(err)
+		var a fuse.Attr
+		cv.So(node.(*ovFile).Attr(ctx, &a), cv.ShouldBeNil)
+		cv.So(a.Uid, cv.ShouldEqual, 1000)
+		cv.So(a.Gid, cv.ShouldEqual, 100)
+		cv.So(a.Mode, cv.ShouldEqual, os.FileMode(0660))
+
+		a = fuse.Attr{}
+		cv.So(sub.(*ovDir).Attr(ctx, &a), cv.ShouldBeNil)
+		cv.So(a.Mode, cv.ShouldEqual, os.ModeDir|0755)
+
+		// the root keeps the zip's mode, not the overlay directory's.
+		panicOn(os.Chmod(dir, 0700))
+		a = fuse.Attr{}
+		cv.So(rootDir.Attr(ctx, &a), cv.ShouldBeNil)
+		cv.So(a.Mode, cv.ShouldEqual, os.ModeDir|0755)
+		cv.So(a.Uid, cv.ShouldEqual, 1000)
+	})
+}
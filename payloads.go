@@ -0,0 +1,173 @@
+package libzipfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// A combo file can carry named payloads besides its zip: further
+// zips, laid end to end between the zip and the footer,
+//
+//	exe | zip | payload 1 | ... | payload n | footer
+//
+// and listed in a payload table kept in the footer metadata (which
+// makes it a v2 footer) under payloadTableKey. Each one can be
+// mounted on its own, with MountComboZipNamed.
+
+// Metadata keys starting with reservedMetaPrefix are for libzipfs's
+// own use.
+const reservedMetaPrefix = "libzipfs."
+
+const payloadTableKey = reservedMetaPrefix + "payloads"
+
+// NamedPayload is a zip for the combiner to add under Name.
+type NamedPayload struct {
+	Name string
+	Path string
+}
+
+// Payload is an entry of the payload table of a combo file.
+type Payload struct {
+	Name           string
+	Offset         int64 // from the start of the combo file
+	Length         int64
+	Blake2Checksum [BLAKE2_HASH_LEN]byte
+}
+
+// Payload returns the named payload.
+func (foot *Footer) Payload(name string) (*Payload, bool) {
+	for i := range foot.Payloads {
+		if foot.Payloads[i].Name == name {
+			return &foot.Payloads[i], true
+		}
+	}
+	return nil, false
+}
+
+// encodePayloads lays out the payload table: for each payload,
+//
+//	[uint16 name length][name][int64 offset][int64 length][blake2 checksum]
+func encodePayloads(pls []Payload) ([]byte, error) {
+	var buf bytes.Buffer
+	seen := make(map[string]bool)
+	for _, pl := range pls {
+		if len(pl.Name) == 0 || len(pl.Name) > math.MaxUint16 {
+			return nil, fmt.Errorf("payload name '%s' must be 1 to %d bytes long", pl.Name, math.MaxUint16)
+		}
+		if seen[pl.Name] {
+			return nil, fmt.Errorf("payload name '%s' used twice", pl.Name)
+		}
+		seen[pl.Name] = true
+		binary.Write(&buf, binary.BigEndian, uint16(len(pl.Name)))
+		buf.WriteString(pl.Name)
+		binary.Write(&buf, binary.BigEndian, pl.Offset)
+		binary.Write(&buf, binary.BigEndian, pl.Length)
+		buf.Write(pl.Blake2Checksum[:])
+	}
+	return buf.Bytes(), nil
+}
+
+func decodePayloads(by []byte) ([]Payload, error) {
+	var pls []Payload
+	for len(by) > 0 {
+		if len(by) < 2 {
+			return nil, fmt.Errorf("payload table truncated in a name length")
+		}
+		n := int(binary.BigEndian.Uint16(by))
+		by = by[2:]
+		if len(by) < n+16+BLAKE2_HASH_LEN {
+			return nil, fmt.Errorf("payload table truncated")
+		}
+		pl := Payload{
+			Name:   string(by[:n]),
+			Offset: int64(binary.BigEndian.Uint64(by[n:])),
+			Length: int64(binary.BigEndian.Uint64(by[n+8:])),
+		}
+		copy(pl.Blake2Checksum[:], by[n+16:])
+		pls = append(pls, pl)
+		by = by[n+16+BLAKE2_HASH_LEN:]
+	}
+	return pls, nil
+}
+
+// footerMetadata is what the footer metadata for m and the payloads
+// pls comes to.
+func footerMetadata(m map[string][]byte, pls []Payload) (map[string][]byte, error) {
+	if len(m) == 0 && len(pls) == 0 {
+		return nil, nil
+	}
+	meta := make(map[string][]byte)
+	for k, v := range m {
+		if strings.HasPrefix(k, reservedMetaPrefix) {
+			return nil, fmt.Errorf("metadata key '%s' is reserved: keys starting '%s' are for libzipfs itself", k, reservedMetaPrefix)
+		}
+		meta[k] = v
+	}
+	if len(pls) > 0 {
+		table, err := encodePayloads(pls)
+		if err != nil {
+			return nil, err
+		}
+		meta[payloadTableKey] = table
+	}
+	return meta, nil
+}
+
+// checkPayloads makes sure the payloads of foot lie end to end
+// between its zip and the footer, which starts footerStartOffset
+// bytes in.
+func (foot *Footer) checkPayloads(footerStartOffset int64) error {
+	off := foot.ExecutableLengthBytes + foot.ZipfileLengthBytes
+	for _, pl := range foot.Payloads {
+		if pl.Offset != off || pl.Length < 0 {
+			return fmt.Errorf("payload '%s' at offset %d (%d bytes) is not where expected, at offset %d", pl.Name, pl.Offset, pl.Length, off)
+		}
+		off += pl.Length
+	}
+	if off != footerStartOffset {
+		return fmt.Errorf("consistency check failed: footerStartOffset(%d) != the end of the exe, zip and payloads (%d)", footerStartOffset, off)
+	}
+	return nil
+}
+
+// ComboZipLayer reads the footer of the combo file at path, and
+// locates the zip in it called payload ("" => the zip given to the
+// combiner with -zip).
+func ComboZipLayer(path, payload string) (ZipLayer, *Footer, error) {
+	_, foot, comb, err := ReadFooter(path)
+	if err != nil {
+		return ZipLayer{}, nil, err
+	}
+	comb.Close()
+	l := ZipLayer{
+		ZipfilePath:              path,
+		Payload:                  payload,
+		ByteOffsetToZipFileStart: foot.ExecutableLengthBytes,
+		BytesAvail:               foot.ZipfileLengthBytes,
+		FooterBytes:              foot.FooterLengthBytes,
+	}
+	if payload != "" {
+		pl, ok := foot.Payload(payload)
+		if !ok {
+			return ZipLayer{}, nil, fmt.Errorf("combo file '%s' has no payload named '%s'", path, payload)
+		}
+		l.ByteOffsetToZipFileStart = pl.Offset
+		l.BytesAvail = pl.Length
+	}
+	return l, foot, nil
+}
+
+// zipChecksum is the blake2 checksum of the zip called payload.
+func (foot *Footer) zipChecksum(payload string) ([BLAKE2_HASH_LEN]byte, bool) {
+	if payload == "" {
+		return foot.ZipfileBlake2Checksum, true
+	}
+	pl, ok := foot.Payload(payload)
+	if !ok {
+		return [BLAKE2_HASH_LEN]byte{}, false
+	}
+	return pl.Blake2Checksum, true
+}
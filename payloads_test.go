@@ -0,0 +1,77 @@
+package libzipfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test026NamedPayloadsMountAndSplitOnTheirOwn(t *testing.T) {
+
+	cv.Convey("a combo with named payloads should list them in its footer, and each should be mountable and extractable by name", t, func() {
+		dir, err := ioutil.TempDir("", "libzipfs.payloads.")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		writeTestZip(filepath.Join(dir, "web.zip"), "index.html", "css/site.css")
+		writeTestZip(filepath.Join(dir, "r.zip"), "library/base/R/base.rdb")
+
+		combo := filepath.Join(dir, "combo")
+		cfg := CombinerConfig{
+			ExecutablePath: "testfiles/tester",
+			ZipfilePath:    "testfiles/hi.zip",
+			OutputPath:     combo,
+			Payloads: []NamedPayload{
+				{Name: "web-assets", Path: filepath.Join(dir, "web.zip")},
+				{Name: "r-libs", Path: filepath.Join(dir, "r.zip")},
+			},
+		}
+		panicOn(DoCombineExeAndZip(&cfg))
+
+		_, foot, comb, err := ReadFooter(combo)
+		cv.So(err, cv.ShouldBeNil)
+		comb.Close()
+		cv.So(len(foot.Payloads), cv.ShouldEqual, 2)
+		cv.So(foot.Payloads[0].Name, cv.ShouldEqual, "web-assets")
+		cv.So(foot.Payloads[0].Offset, cv.ShouldEqual, foot.ExecutableLengthBytes+foot.ZipfileLengthBytes)
+
+		names := func(payload string) []string {
+			l, _, err := ComboZipLayer(combo, payload)
+			panicOn(err)
+			fd, al, err := l.open()
+			panicOn(err)
+			defer fd.Close()
+			var res []string
+			for _, f := range al.archive.File {
+				res = append(res, f.Name)
+			}
+			return res
+		}
+		cv.So(names("web-assets"), cv.ShouldResemble, []string{"index.html", "css/site.css"})
+		cv.So(names("r-libs"), cv.ShouldResemble, []string{"library/base/R/base.rdb"})
+		cv.So(names(""), cv.ShouldResemble, []string{"dirA/", "dirA/dirB/", "dirA/dirB/hello"})
+		_, _, err = ComboZipLayer(combo, "fixtures")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		split := cfg
+		split.Split = true
+		split.ExecutablePath = filepath.Join(dir, "exe")
+		split.ZipfilePath = filepath.Join(dir, "extracted.zip")
+		split.ExtractPayload = "r-libs"
+		_, err = DoSplitOutExeAndZip(&split)
+		cv.So(err, cv.ShouldBeNil)
+		want, err := ioutil.ReadFile(filepath.Join(dir, "r.zip"))
+		panicOn(err)
+		got, err := ioutil.ReadFile(split.ZipfilePath)
+		panicOn(err)
+		cv.So(string(got), cv.ShouldEqual, string(want))
+
+		// libzipfs.* metadata keys are ours.
+		bad := cfg
+		bad.OutputPath = filepath.Join(dir, "bad")
+		bad.Metadata = map[string][]byte{payloadTableKey: []byte("x")}
+		cv.So(DoCombineExeAndZip(&bad), cv.ShouldNotBeNil)
+	})
+}
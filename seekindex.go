@@ -0,0 +1,197 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// seekIndex lists checkpoints into one deflated entry, at least
+// spacing uncompressed bytes apart, so that a read at any offset only
+// has to decompress from the nearest checkpoint before it.
+type seekIndex struct {
+	points []checkpoint
+}
+
+// buildSeekIndex decompresses the deflate stream in compressed once,
+// recording a checkpoint every spacing bytes of output. It gives up
+// with errInterrupted if ctx is cancelled first.
+func buildSeekIndex(ctx context.Context, compressed *io.SectionReader, spacing int64) (*seekIndex, error) {
+	ix := &seekIndex{}
+	z := newInflater(compressed)
+	z.onCheckpoint = func(z *inflater) {
+		ix.points = append(ix.points, z.checkpoint())
+		z.nextCheckpoint = z.out + spacing
+	}
+	_, err := io.Copy(ioutil.Discard, &ctxReader{ctx, z})
+	if err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+// find returns the last checkpoint at or before uncompressed offset off.
+func (ix *seekIndex) find(off int64) *checkpoint {
+	i := sort.Search(len(ix.points), func(i int) bool {
+		return ix.points[i].out > off
+	})
+	return &ix.points[i-1]
+}
+
+// indexEntry lets concurrent opens of the same entry share one build.
+// A build that was interrupted doesn't count, and the next caller
+// starts it again.
+type indexEntry struct {
+	mut  sync.Mutex
+	done bool
+	ix   *seekIndex
+	err  error
+}
+
+// seekIndexFor returns the seekIndex for the deflated entry f, building
+// it the first time it is asked for.
+func (fsys *FS) seekIndexFor(ctx context.Context, f *zip.File) (*seekIndex, error) {
+	fsys.mut.Lock()
+	if fsys.indexes == nil {
+		fsys.indexes = make(map[*zip.File]*indexEntry)
+	}
+	e, ok := fsys.indexes[f]
+	if !ok {
+		e = &indexEntry{}
+		fsys.indexes[f] = e
+	}
+	fsys.mut.Unlock()
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.done {
+		return e.ix, e.err
+	}
+	sr, err := fsys.compressedData(f)
+	if err != nil {
+		return nil, err
+	}
+	ix, err := buildSeekIndex(ctx, sr, fsys.checkpointSpacing())
+	if err == errInterrupted {
+		return nil, err
+	}
+	e.ix, e.err, e.done = ix, err, true
+	if err == nil {
+		VPrintf("built seek index for '%s' with %d checkpoints\n", f.Name, len(ix.points))
+	}
+	return ix, err
+}
+
+// compressedData returns the raw bytes of f as they sit in the zipfile.
+func (fsys *FS) compressedData(f *zip.File) (*io.SectionReader, error) {
+	off, err := f.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+	fsys.mut.Lock()
+	ra := fsys.dataOf[f]
+	fsys.mut.Unlock()
+	return io.NewSectionReader(ra, off, int64(f.CompressedSize64)), nil
+}
+
+func (fsys *FS) checkpointSpacing() int64 {
+	kib := fsys.opts.SeekCheckpointKiB
+	if kib <= 0 {
+		kib = DefaultSeekCheckpointKiB
+	}
+	return int64(kib) << 10
+}
+
+// deflateReaderAt gives random access to a deflated entry. Reads that
+// carry on from where the last one stopped are served from the
+// archive/zip stream, which is fast and checks the CRC; a read anywhere
+// else switches over to an inflater resumed from the seekIndex.
+type deflateReaderAt struct {
+	mut  sync.Mutex
+	fsys *FS
+	file *zip.File
+
+	seq io.ReadCloser // the archive/zip stream, until we first seek
+	z   *inflater
+	pos int64 // uncompressed offset of the next byte from seq or z
+}
+
+func newDeflateReaderAt(fsys *FS, f *zip.File) (*deflateReaderAt, error) {
+	seq, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &deflateReaderAt{fsys: fsys, file: f, seq: seq}, nil
+}
+
+func (d *deflateReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return d.readAtCtx(context.Background(), p, off)
+}
+
+// readAtCtx is ReadAt, giving up with errInterrupted if ctx is
+// cancelled while we decompress our way to off.
+func (d *deflateReaderAt) readAtCtx(ctx context.Context, p []byte, off int64) (int, error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	size := int64(d.file.UncompressedSize64)
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	var r io.Reader
+	switch {
+	case d.seq != nil && off >= d.pos && off-d.pos < d.fsys.checkpointSpacing():
+		r = d.seq
+	case d.z != nil && off >= d.pos && off-d.pos < d.fsys.checkpointSpacing():
+		r = d.z
+	default:
+		if d.seq != nil {
+			d.seq.Close()
+			d.seq = nil
+		}
+		ix, err := d.fsys.seekIndexFor(ctx, d.file)
+		if err != nil {
+			return 0, err
+		}
+		compressed, err := d.fsys.compressedData(d.file)
+		if err != nil {
+			return 0, err
+		}
+		cp := ix.find(off)
+		d.z, err = resumeInflater(compressed, compressed.Size(), cp)
+		if err != nil {
+			return 0, err
+		}
+		d.pos = cp.out
+		r = d.z
+	}
+
+	r = &ctxReader{ctx, r}
+	if off > d.pos {
+		skipped, err := io.CopyN(ioutil.Discard, r, off-d.pos)
+		d.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(r, p)
+	d.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (d *deflateReaderAt) Close() error {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if d.seq != nil {
+		return d.seq.Close()
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package libzipfs
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The blake2 checksums of a footer catch corruption, but anyone can
+// recompute them. Given a private key (libzipfs-combiner -sign), the
+// combiner also signs the footer with Ed25519, and records
+//
+//	[32 byte public key][64 byte signature]
+//
+// in the footer metadata under signatureKey. The signature covers the
+// lengths and checksums of the exe and zip, the hash algorithm, and
+// all the other metadata, payload table included (see signedMessage);
+// so a zip that hashes to the signed checksum is the zip that was
+// signed.
+
+const signatureKey = reservedMetaPrefix + "signature"
+
+// signatureContext starts every signed message, so that a libzipfs
+// signature can't be passed off as a signature of anything else.
+const signatureContext = "libzipfs footer signature v1\n"
+
+// TrustedKeys are the public keys whose signatures mounts with
+// MountOptions.RequireSignature accept, unless their own
+// MountOptions.TrustedKeys say otherwise. Compile yours into the
+// program that mounts its combo, e.g.
+//
+//	func init() {
+//		libzipfs.TrustedKeys = append(libzipfs.TrustedKeys,
+//			libzipfs.MustParsePublicKey("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"))
+//	}
+var TrustedKeys []ed25519.PublicKey
+
+var (
+	ErrUnsigned        = errors.New("combo file is not signed")
+	ErrUntrustedSigner = errors.New("combo file is signed with a key that is not trusted")
+	ErrBadSignature    = errors.New("combo file signature does not verify")
+)
+
+// SignatureError is what Start() returns for a zip that
+// MountOptions.RequireSignature turns away. Err is ErrUnsigned,
+// ErrUntrustedSigner or ErrBadSignature, or what went wrong checking.
+type SignatureError struct {
+	Path    string
+	Payload string
+	Err     error
+}
+
+func (e *SignatureError) Error() string {
+	if e.Payload != "" {
+		return fmt.Sprintf("payload '%s' of '%s': %s", e.Payload, e.Path, e.Err)
+	}
+	return fmt.Sprintf("'%s': %s", e.Path, e.Err)
+}
+
+// signedMessage is what the signature of foot signs.
+func (foot *Footer) signedMessage() ([]byte, error) {
+	meta := make(map[string][]byte)
+	for k, v := range foot.Metadata {
+		if k != signatureKey {
+			meta[k] = v
+		}
+	}
+	region, err := encodeMetadata(meta, foot.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(signatureContext)
+	binary.Write(&buf, binary.BigEndian, foot.ExecutableLengthBytes)
+	binary.Write(&buf, binary.BigEndian, foot.ZipfileLengthBytes)
+	buf.Write(foot.ExecutableBlake2Checksum[:])
+	buf.Write(foot.ZipfileBlake2Checksum[:])
+	buf.Write(region)
+	buf.WriteByte(byte(foot.HashAlgorithm))
+	return buf.Bytes(), nil
+}
+
+// sign adds the signature of foot by key to its metadata. The exe and
+// zip checksums and all other metadata must already be in place.
+func (foot *Footer) sign(key ed25519.PrivateKey) error {
+	msg, err := foot.signedMessage()
+	if err != nil {
+		return err
+	}
+	if foot.Metadata == nil {
+		foot.Metadata = make(map[string][]byte)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	foot.Metadata[signatureKey] = append(append([]byte{}, pub...), ed25519.Sign(key, msg)...)
+	return nil
+}
+
+// Signer gives the public key foot is signed with, if it is signed.
+// Use VerifySignature to find out whether the signature is good.
+func (foot *Footer) Signer() (ed25519.PublicKey, bool) {
+	sig, ok := foot.Meta(signatureKey)
+	if !ok || len(sig) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, false
+	}
+	return ed25519.PublicKey(sig[:ed25519.PublicKeySize]), true
+}
+
+// VerifySignature checks that foot is signed by one of keys, usually
+// TrustedKeys. It returns ErrUnsigned, ErrUntrustedSigner or
+// ErrBadSignature if not.
+//
+// This checks the footer alone. To trust a zip, also check that it
+// has the checksum the footer gives; mounts with
+// MountOptions.RequireSignature do both.
+func (foot *Footer) VerifySignature(keys []ed25519.PublicKey) error {
+	sig, ok := foot.Meta(signatureKey)
+	if !ok {
+		return ErrUnsigned
+	}
+	if len(sig) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return ErrBadSignature
+	}
+	pub := ed25519.PublicKey(sig[:ed25519.PublicKeySize])
+	trusted := false
+	for _, k := range keys {
+		if bytes.Equal(k, pub) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return ErrUntrustedSigner
+	}
+	msg, err := foot.signedMessage()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, msg, sig[ed25519.PublicKeySize:]) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// checkSignature makes sure the zip of l, open as al, is the one
+// signed in its combo's footer by one of keys.
+func checkSignature(l ZipLayer, al archiveLayer, keys []ed25519.PublicKey) error {
+	serr := &SignatureError{Path: l.ZipfilePath, Payload: l.Payload}
+	if !l.isCombo() {
+		serr.Err = ErrUnsigned
+		return serr
+	}
+	_, foot, err := ComboZipLayer(l.ZipfilePath, l.Payload)
+	if err != nil {
+		serr.Err = err
+		return serr
+	}
+	err = foot.VerifySignature(keys)
+	if err != nil {
+		serr.Err = err
+		return serr
+	}
+
+	// the footer is good; now for the zip we actually have open,
+	// which must be just the bytes it vouches for.
+	err = foot.checkZip(l, al)
+	if _, mismatch := err.(*ChecksumError); mismatch {
+		VPrintf("checkSignature: %s\n", err)
+		err = ErrBadSignature
+	}
+	if err != nil {
+		serr.Err = err
+		return serr
+	}
+	return nil
+}
+
+// ParsePublicKey reads a hex-encoded Ed25519 public key, as written
+// to the .pub file by GenerateSigningKey.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("public key is not hex: '%s'", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, not %d", len(b), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// MustParsePublicKey is ParsePublicKey for keys compiled in; it
+// panics on a bad key.
+func MustParsePublicKey(s string) ed25519.PublicKey {
+	k, err := ParsePublicKey(s)
+	panicOn(err)
+	return k
+}
+
+// ReadPublicKey reads the public key file at path.
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	by, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ParsePublicKey(string(by))
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %s", path, err)
+	}
+	return k, nil
+}
+
+// ReadSigningKey reads the private key file at path: a hex-encoded
+// Ed25519 private key, or just its 32 byte seed.
+func ReadSigningKey(path string) (ed25519.PrivateKey, error) {
+	by, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(by)))
+	if err != nil {
+		return nil, fmt.Errorf("signing key '%s' is not hex: '%s'", path, err)
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		key := ed25519.NewKeyFromSeed(b[:ed25519.SeedSize])
+		if !bytes.Equal(key, b) {
+			return nil, fmt.Errorf("signing key '%s' is corrupt: its public half does not match", path)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("signing key '%s' is %d bytes, not %d or %d", path, len(b), ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// GenerateSigningKey makes a new key pair, writing the private key
+// to path, readable by its owner alone, and the public key to
+// path + ".pub".
+func GenerateSigningKey(path string) (ed25519.PublicKey, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(fd, "%x\n", []byte(key))
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	err = ioutil.WriteFile(path+".pub", []byte(fmt.Sprintf("%x\n", []byte(pub))), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
@@ -0,0 +1,141 @@
+package libzipfs
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test027SignedCombosVerifyAgainstTrustedKeys(t *testing.T) {
+
+	cv.Convey("a combo signed by the combiner should verify against its public key only, and mounts requiring a signature should refuse unsigned, untrusted and tampered zips", t, func() {
+		dir, err := ioutil.TempDir("", "libzipfs.signing.")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+
+		keyPath := filepath.Join(dir, "release.key")
+		pub, err := GenerateSigningKey(keyPath)
+		panicOn(err)
+		readPub, err := ReadPublicKey(keyPath + ".pub")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(readPub, cv.ShouldResemble, pub)
+		_, err = GenerateSigningKey(keyPath)
+		cv.So(err, cv.ShouldNotBeNil)
+		otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+		panicOn(err)
+
+		writeTestZip(filepath.Join(dir, "web.zip"), "index.html")
+		signed := filepath.Join(dir, "signed")
+		cfg := CombinerConfig{
+			ExecutablePath: "testfiles/tester",
+			ZipfilePath:    "testfiles/hi.zip",
+			OutputPath:     signed,
+			Metadata:       map[string][]byte{"build": []byte("v1.2.3")},
+			Payloads:       []NamedPayload{{Name: "web-assets", Path: filepath.Join(dir, "web.zip")}},
+			SigningKeyPath: keyPath,
+		}
+		panicOn(DoCombineExeAndZip(&cfg))
+
+		_, foot, comb, err := ReadFooter(signed)
+		cv.So(err, cv.ShouldBeNil)
+		comb.Close()
+		signer, ok := foot.Signer()
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(signer, cv.ShouldResemble, pub)
+		cv.So(foot.VerifySignature([]ed25519.PublicKey{otherPub, pub}), cv.ShouldBeNil)
+		cv.So(foot.VerifySignature([]ed25519.PublicKey{otherPub}), cv.ShouldEqual, ErrUntrustedSigner)
+		cv.So(foot.VerifySignature(nil), cv.ShouldEqual, ErrUntrustedSigner)
+
+		// changing anything signed spoils the signature.
+		foot.Metadata["build"] = []byte("v6.6.6")
+		cv.So(foot.VerifySignature([]ed25519.PublicKey{pub}), cv.ShouldEqual, ErrBadSignature)
+		foot.Metadata["build"] = []byte("v1.2.3")
+		foot.ZipfileBlake2Checksum[0]++
+		cv.So(foot.VerifySignature([]ed25519.PublicKey{pub}), cv.ShouldEqual, ErrBadSignature)
+		foot.ZipfileBlake2Checksum[0]--
+
+		unsigned := filepath.Join(dir, "unsigned")
+		plain := cfg
+		plain.OutputPath = unsigned
+		plain.SigningKeyPath = ""
+		panicOn(DoCombineExeAndZip(&plain))
+		_, ufoot, comb, err := ReadFooter(unsigned)
+		cv.So(err, cv.ShouldBeNil)
+		comb.Close()
+		cv.So(ufoot.VerifySignature([]ed25519.PublicKey{pub}), cv.ShouldEqual, ErrUnsigned)
+
+		// as a mount with RequireSignature checks them.
+		check := func(path, payload string) error {
+			l := ZipLayer{ZipfilePath: path}
+			if path != "testfiles/hi.zip" {
+				l, _, err = ComboZipLayer(path, payload)
+				panicOn(err)
+			}
+			fd, al, err := l.open()
+			panicOn(err)
+			defer fd.Close()
+			err = checkSignature(l, al, []ed25519.PublicKey{pub})
+			if err != nil {
+				return err.(*SignatureError).Err
+			}
+			return nil
+		}
+		cv.So(check(signed, ""), cv.ShouldBeNil)
+		cv.So(check(signed, "web-assets"), cv.ShouldBeNil)
+		cv.So(check(unsigned, ""), cv.ShouldEqual, ErrUnsigned)
+		cv.So(check("testfiles/hi.zip", ""), cv.ShouldEqual, ErrUnsigned)
+
+		// a byte changed in the zip, past its directory, still
+		// opens, but doesn't have the signed checksum.
+		by, err := ioutil.ReadFile(signed)
+		panicOn(err)
+		by[foot.ExecutableLengthBytes+31]++
+		tampered := filepath.Join(dir, "tampered")
+		panicOn(ioutil.WriteFile(tampered, by, 0755))
+		cv.So(check(tampered, ""), cv.ShouldEqual, ErrBadSignature)
+		cv.So(check(tampered, "web-assets"), cv.ShouldBeNil)
+
+		// Start() checks against the mount's own keys, if it has
+		// any, and closes the zips it opened when it refuses.
+		defer func(saved []ed25519.PublicKey) { TrustedKeys = saved }(TrustedKeys)
+		TrustedKeys = []ed25519.PublicKey{pub}
+		openFds := func() int {
+			fds, err := ioutil.ReadDir("/proc/self/fd")
+			panicOn(err)
+			return len(fds)
+		}
+		start := func(path string, keys ...ed25519.PublicKey) error {
+			l, _, err := ComboZipLayer(path, "")
+			panicOn(err)
+			p := NewUnionFuseZipFs([]ZipLayer{l}, dir)
+			p.RequireSignature = true
+			p.TrustedKeys = keys
+			before := openFds()
+			err = p.Start()
+			cv.So(openFds(), cv.ShouldEqual, before)
+			return err.(*SignatureError).Err
+		}
+		cv.So(start(signed, otherPub), cv.ShouldEqual, ErrUntrustedSigner)
+		cv.So(start(unsigned), cv.ShouldEqual, ErrUnsigned)
+		cv.So(start(tampered, pub), cv.ShouldEqual, ErrBadSignature)
+		opts := &MountOptions{}
+		cv.So(opts.trustedKeys(), cv.ShouldResemble, []ed25519.PublicKey{pub})
+		opts.TrustedKeys = []ed25519.PublicKey{otherPub}
+		cv.So(opts.trustedKeys(), cv.ShouldResemble, []ed25519.PublicKey{otherPub})
+
+		// a bare seed makes the same key.
+		seedPath := filepath.Join(dir, "seed.key")
+		key, err := ReadSigningKey(keyPath)
+		panicOn(err)
+		panicOn(ioutil.WriteFile(seedPath, []byte(hex.EncodeToString(key.Seed())), 0600))
+		fromSeed, err := ReadSigningKey(seedPath)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(fromSeed, cv.ShouldResemble, key)
+	})
+}
@@ -62,6 +62,27 @@ func ReadFooter(combinedPath string) (footerStartOffset int64, ft *Footer, comb
 			combinedPath, footerStartOffset, n, LIBZIPFS_FOOTER_LEN)
 	}
 
+	// a v2 footer has its metadata region ahead of the trailer we
+	// just read; read the whole footer, once we know the trailer
+	// is sound.
+	var trailer Footer
+	trailer.FromBytes(by)
+	chk := trailer.GetFooterChecksum()
+	sound := chk != nil && padChecksum(chk) == trailer.FooterBlake2Checksum
+	if metaLen := trailer.MetadataLengthBytes; sound && trailer.IsV2() && metaLen > 0 {
+		if metaLen > footerStartOffset {
+			return -1, nil, nil, fmt.Errorf("footer of '%s' claims %d bytes of metadata, more than the "+
+				"%d bytes ahead of it; file corrupt or not a combined file?", combinedPath, metaLen, footerStartOffset)
+		}
+		footerStartOffset -= metaLen
+		by = make([]byte, LIBZIPFS_FOOTER_LEN+metaLen)
+		_, err = comb.ReadAt(by, footerStartOffset)
+		if err != nil {
+			return -1, nil, nil, fmt.Errorf("could not read the footer metadata inside file '%s': '%s'",
+				combinedPath, err)
+		}
+	}
+
 	// must return err if foot is bad
 	var foot *Footer
 	foot, err = ReifyFooterAndDoInexpensiveChecks(by[:], combinedPath, footerStartOffset)
@@ -100,6 +121,17 @@ func DoSplitOutExeAndZip(cfg *CombinerConfig) (*Footer, error) {
 	panicOn(err)
 	defer zipFd.Close()
 
+	if cfg.ExtractPayload != "" {
+		pl, ok := foot.Payload(cfg.ExtractPayload)
+		if !ok {
+			return nil, fmt.Errorf("DoSplitOutExeAndZip() error: '%s' has no payload named '%s'", cfg.OutputPath, cfg.ExtractPayload)
+		}
+		_, err = io.Copy(zipFd, io.NewSectionReader(comb, pl.Offset, pl.Length))
+		panicOn(err)
+		zipFd.Close()
+		return foot, foot.VerifyExePayloadChecksums(cfg, pl)
+	}
+
 	_, err = io.CopyN(zipFd, comb, foot.ZipfileLengthBytes)
 	panicOn(err)
 	zipFd.Close()
@@ -110,14 +142,22 @@ func DoSplitOutExeAndZip(cfg *CombinerConfig) (*Footer, error) {
 }
 
 // must return err if foot is bad
+//
+// by holds the whole footer, which starts footerStartOffset bytes
+// into the combined file: the trailer alone for a v00 footer, and
+// the metadata region then the trailer for a v2 footer.
 func ReifyFooterAndDoInexpensiveChecks(by []byte, combinedPath string, footerStartOffset int64) (*Footer, error) {
 	var err error
 	var foot Footer
-	foot.FromBytes(by[:])
+	if len(by) < LIBZIPFS_FOOTER_LEN {
+		return nil, fmt.Errorf("footer too short: %d bytes", len(by))
+	}
+	region, trailer := by[:len(by)-LIBZIPFS_FOOTER_LEN], by[len(by)-LIBZIPFS_FOOTER_LEN:]
+	foot.FromBytes(trailer)
 
 	// NB must use len(MAGIC1) instead of MAGIC_NUM_LEN since len(MAGIC1) is smaller
 	_, err = compareByteSlices(foot.MagicFooterNumber1[:len(MAGIC1)], MAGIC1, len(MAGIC1))
-	if err != nil {
+	if err != nil && !foot.IsV2() {
 		return nil, fmt.Errorf("footer magic number1 not found")
 	}
 
@@ -126,11 +166,39 @@ func ReifyFooterAndDoInexpensiveChecks(by []byte, combinedPath string, footerSta
 		return nil, fmt.Errorf("footer magic number2 not found")
 	}
 
+	if !foot.HashAlgorithm.valid() {
+		return nil, fmt.Errorf("footer from file '%s' uses unknown hash algorithm %d, file corrupt or from a newer libzipfs?", combinedPath, foot.HashAlgorithm)
+	}
+
 	// check the checksum over the footer itself
 	chk := foot.GetFooterChecksum()
-	for i := 0; i < 64; i++ {
-		if chk[i] != foot.FooterBlake2Checksum[i] {
-			return nil, fmt.Errorf("DoSplitOutexeAndZip() error: reified footer from file '%s' does not have the expected checksum, file corrupt or not a combined file?  at i=%d, disk position footerStartOffset=%d, computed footer checksum='%x', versus read-from-disk footer checksum = '%x'", combinedPath, i, footerStartOffset, chk, foot.FooterBlake2Checksum)
+	if padChecksum(chk) != foot.FooterBlake2Checksum {
+		return nil, fmt.Errorf("DoSplitOutexeAndZip() error: reified footer from file '%s' does not have the expected %s checksum, file corrupt or not a combined file?  disk position footerStartOffset=%d, computed footer checksum='%x', versus read-from-disk footer checksum = '%x'", combinedPath, foot.HashAlgorithm, footerStartOffset, chk, foot.FooterBlake2Checksum)
+	}
+
+	// the metadata region, if any
+	if foot.MetadataLengthBytes != int64(len(region)) || (len(region) > 0 && !foot.IsV2()) {
+		return nil, fmt.Errorf("footer from file '%s' has %d bytes of metadata, but %d were expected",
+			combinedPath, len(region), foot.MetadataLengthBytes)
+	}
+	if foot.FooterLengthBytes != int64(len(by)) {
+		return nil, fmt.Errorf("footer from file '%s' is %d bytes long, but says it is %d",
+			combinedPath, len(by), foot.FooterLengthBytes)
+	}
+	if foot.IsV2() {
+		foot.Metadata, err = decodeMetadata(region, foot.HashAlgorithm)
+		if err != nil {
+			return nil, fmt.Errorf("footer from file '%s': %s", combinedPath, err)
+		}
+		if table, ok := foot.Metadata[payloadTableKey]; ok {
+			foot.Payloads, err = decodePayloads(table)
+			if err == nil {
+				err = foot.checkPayloads(footerStartOffset)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("footer from file '%s': %s", combinedPath, err)
+			}
+			return &foot, nil
 		}
 	}
 
@@ -0,0 +1,58 @@
+package libzipfs
+
+import (
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const (
+	statfsBlockSize = 4096
+	maxNameLen      = 255
+)
+
+// treeStats counts the entries below and including n, and the
+// uncompressed bytes in the files among them.
+func treeStats(n *treeNode) (entries, bytes uint64) {
+	entries = 1
+	if n.file != nil && !n.isDir {
+		bytes = n.file.UncompressedSize64
+	}
+	for _, c := range n.order {
+		e, b := treeStats(c)
+		entries += e
+		bytes += b
+	}
+	return entries, bytes
+}
+
+var _ = fs.FSStatfser(&FS{})
+
+// Statfs describes the mount to df and friends: it is exactly as
+// big as the uncompressed archive, and full, unless it is writable,
+// when it has the space left in the overlay directory free too. The
+// read-only flag comes from mounting with fuse.ReadOnly().
+func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	f.treeMut.RLock()
+	defer f.treeMut.RUnlock()
+	resp.Bsize = statfsBlockSize
+	resp.Frsize = statfsBlockSize
+	resp.Blocks = (f.payloadBytes + statfsBlockSize - 1) / statfsBlockSize
+	resp.Files = f.entries
+	resp.Namelen = maxNameLen
+	if f.overlay != nil {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(f.overlay.dir, &st); err != nil {
+			return toFuseErr(err)
+		}
+		bsize := uint64(st.Bsize)
+		resp.Bfree = st.Bfree * bsize / statfsBlockSize
+		resp.Bavail = st.Bavail * bsize / statfsBlockSize
+		resp.Blocks += resp.Bfree
+		resp.Ffree = st.Ffree
+		resp.Files += st.Ffree
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+func Test030StoredEntriesReadAtAnyOffset(t *testing.T) {
+
+	cv.Convey("an entry stored without compression should read back at any offset, with short reads at the end and nothing past it", t, func() {
+		data := make([]byte, 100<<10)
+		for i := range data {
+			data[i] = byte(i*7 + i/251)
+		}
+		var zbuf bytes.Buffer
+		zw := zip.NewWriter(&zbuf)
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: "stored.rdb", Method: zip.Store})
+		panicOn(err)
+		w.Write(data)
+		panicOn(zw.Close())
+		fsys := testFS(zbuf.Bytes(), MountOptions{})
+
+		ctx := context.Background()
+		node, err := lookupPath(fsys, "stored.rdb")
+		cv.So(err, cv.ShouldBeNil)
+		h, err := node.(*File).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+		cv.So(err, cv.ShouldBeNil)
+		fh := h.(*FileHandle)
+		defer fh.Release(ctx, &fuse.ReleaseRequest{})
+		cv.So(fh.ra, cv.ShouldNotBeNil)
+
+		size := int64(len(data))
+		for _, off := range []int64{0, 4096, 70000, 12345, size - 100, size} {
+			resp := &fuse.ReadResponse{}
+			cv.So(fh.Read(ctx, &fuse.ReadRequest{Offset: off, Size: 4096}, resp), cv.ShouldBeNil)
+			end := off + 4096
+			if end > size {
+				end = size
+			}
+			cv.So(bytes.Equal(resp.Data, data[off:end]), cv.ShouldBeTrue)
+		}
+		resp := &fuse.ReadResponse{}
+		cv.So(fh.Read(ctx, &fuse.ReadRequest{Offset: size + 5000, Size: 4096}, resp), cv.ShouldBeNil)
+		cv.So(len(resp.Data), cv.ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,123 @@
+package libzipfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// SymlinkPolicy says what to do with symlinks in the zip whose
+// target lies outside the archive, such as `/usr/lib/libfoo.so` or
+// `../../etc/passwd`. Links that stay inside the archive are always
+// served as they are.
+type SymlinkPolicy int
+
+const (
+	// SymlinkReject fails readlink on escaping links with EACCES.
+	SymlinkReject SymlinkPolicy = iota
+
+	// SymlinkAllow serves escaping links verbatim, so they point
+	// out of the mount into the host filesystem.
+	SymlinkAllow
+
+	// SymlinkResolve treats the archive as the root directory:
+	// absolute targets and `..` past the top are taken to mean the
+	// root of the mount, and the link is rewritten to point there.
+	SymlinkResolve
+)
+
+func (p SymlinkPolicy) String() string {
+	switch p {
+	case SymlinkReject:
+		return "reject"
+	case SymlinkAllow:
+		return "allow"
+	case SymlinkResolve:
+		return "resolve"
+	}
+	return fmt.Sprintf("SymlinkPolicy(%d)", int(p))
+}
+
+// ParseSymlinkPolicy is the inverse of SymlinkPolicy.String.
+func ParseSymlinkPolicy(s string) (SymlinkPolicy, error) {
+	for _, p := range []SymlinkPolicy{SymlinkReject, SymlinkAllow, SymlinkResolve} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return SymlinkReject, fmt.Errorf("unknown symlink policy '%s': want reject, allow or resolve", s)
+}
+
+// longest link target we are willing to read out of the zip.
+const maxSymlinkTarget = 4096
+
+func isSymlink(n *treeNode) bool {
+	return n.file != nil && n.file.Mode()&os.ModeSymlink != 0
+}
+
+var _ = fs.NodeReadlinker(&File{})
+
+func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	if f.file.Mode()&os.ModeSymlink == 0 {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	r, err := f.file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	by, err := ioutil.ReadAll(io.LimitReader(r, maxSymlinkTarget))
+	if err != nil {
+		return "", err
+	}
+	target := string(by)
+
+	// with a Subdir mount, the mount root is as far up as links may go.
+	linkDir, _ := splitEntryPath(f.fs.mountPath(f.path))
+	if !symlinkEscapes(linkDir, target) {
+		return target, nil
+	}
+	switch f.fs.opts.SymlinkPolicy {
+	case SymlinkAllow:
+		return target, nil
+	case SymlinkResolve:
+		return resolveSymlinkInside(linkDir, target), nil
+	}
+	VPrintf("Readlink: rejecting '%s' -> '%s', it points outside the archive\n", f.file.Name, target)
+	return "", fuse.Errno(syscall.EACCES)
+}
+
+// symlinkEscapes reports whether target, read from a link in the
+// archive directory linkDir, names something outside the archive.
+func symlinkEscapes(linkDir, target string) bool {
+	if path.IsAbs(target) {
+		return true
+	}
+	p := path.Clean(path.Join(linkDir, target))
+	return p == ".." || strings.HasPrefix(p, "../")
+}
+
+// resolveSymlinkInside rewrites target as a relative link from
+// linkDir, taking the archive to be the whole filesystem.
+func resolveSymlinkInside(linkDir, target string) string {
+	abs := target
+	if !path.IsAbs(target) {
+		abs = path.Join("/", linkDir, target)
+	}
+	// Clean drops any .. that would climb above "/".
+	abs = path.Clean("/" + abs)
+	rel, err := filepath.Rel(path.Join("/", linkDir), abs)
+	if err != nil {
+		return "."
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,67 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"testing"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+func Test010SymlinksAreServedPerPolicy(t *testing.T) {
+
+	cv.Convey("symlink entries should readlink to their target, with links leaving the archive handled by the SymlinkPolicy", t, func() {
+		links := map[string]string{
+			"lib/libfoo.so":   "libfoo.so.1",
+			"lib/abs.so":      "/usr/lib/libfoo.so.1",
+			"lib/sneaky.so":   "../../etc/passwd",
+			"lib/libfoo.so.1": "",
+		}
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, name := range []string{"lib/libfoo.so.1", "lib/libfoo.so", "lib/abs.so", "lib/sneaky.so"} {
+			fh := &zip.FileHeader{Name: name, Method: zip.Store}
+			if links[name] != "" {
+				fh.SetMode(os.ModeSymlink | 0777)
+			}
+			w, err := zw.CreateHeader(fh)
+			panicOn(err)
+			w.Write([]byte(links[name]))
+		}
+		panicOn(zw.Close())
+		readlink := func(policy SymlinkPolicy, name string) (string, error) {
+			fsys := testFS(buf.Bytes(), MountOptions{SymlinkPolicy: policy})
+			node, err := lookupPath(fsys, "lib", name)
+			panicOn(err)
+			return node.(*File).Readlink(context.Background(), &fuse.ReadlinkRequest{})
+		}
+
+		for _, policy := range []SymlinkPolicy{SymlinkReject, SymlinkAllow, SymlinkResolve} {
+			target, err := readlink(policy, "libfoo.so")
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(target, cv.ShouldEqual, "libfoo.so.1")
+		}
+
+		_, err := readlink(SymlinkReject, "abs.so")
+		cv.So(err, cv.ShouldNotBeNil)
+		_, err = readlink(SymlinkReject, "sneaky.so")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		target, err := readlink(SymlinkAllow, "abs.so")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(target, cv.ShouldEqual, "/usr/lib/libfoo.so.1")
+
+		target, err = readlink(SymlinkResolve, "abs.so")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(target, cv.ShouldEqual, "../usr/lib/libfoo.so.1")
+		target, err = readlink(SymlinkResolve, "sneaky.so")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(target, cv.ShouldEqual, "../etc/passwd")
+
+		_, err = readlink(SymlinkAllow, "libfoo.so.1")
+		cv.So(err, cv.ShouldNotBeNil)
+	})
+}
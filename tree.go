@@ -0,0 +1,322 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// treeNode is one entry in the directory tree we build over the
+// archive in Start(), so that Lookup and ReadDirAll need not scan
+// every entry in the zip on each call.
+type treeNode struct {
+	name  string    // base name; "" for the root
+	file  *zip.File // nil for the root, and for directories we made up
+	isDir bool
+
+	// for directories without a zip entry: the newest mtime below.
+	mtime time.Time
+
+	children map[string]*treeNode
+	order    []*treeNode // children sorted by name, for ReadDirAll
+	// children by LookupFold key; nil unless opts.LookupFold is set.
+	folded map[string]*treeNode
+
+	// the Dir or File we hand out for this entry, so that
+	// repeated lookups return the same fs.Node.
+	node fs.Node
+}
+
+func (n *treeNode) addChild(c *treeNode) {
+	if _, dup := n.children[c.name]; dup {
+		// like a scan of the archive would, the first entry wins.
+		return
+	}
+	n.children[c.name] = c
+	n.order = append(n.order, c)
+}
+
+// implicitDirMode is given to directories that have no zip entry.
+const implicitDirMode = os.ModeDir | 0755
+
+func newDirNode(fsys *FS, name string, f *zip.File) *treeNode {
+	n := &treeNode{name: name, file: f, isDir: true, children: make(map[string]*treeNode)}
+	n.node = &Dir{fs: fsys, file: f, n: n}
+	return n
+}
+
+// modTime returns the entry's mtime, working it out from the
+// children for directories that the zip has no entry for.
+func (n *treeNode) modTime() time.Time {
+	var newest time.Time
+	for _, c := range n.order {
+		if t := c.modTime(); t.After(newest) {
+			newest = t
+		}
+	}
+	if n.file != nil {
+		return n.file.ModTime()
+	}
+	n.mtime = newest
+	return newest
+}
+
+func (n *treeNode) direntType() fuse.DirentType {
+	switch {
+	case n.isDir:
+		return fuse.DT_Dir
+	case isSymlink(n):
+		return fuse.DT_Link
+	}
+	return fuse.DT_File
+}
+
+// splitEntryPath splits a zip entry name into its parent directory
+// path and base name, dropping any trailing slash.
+func splitEntryPath(name string) (dir, base string) {
+	name = strings.TrimSuffix(name, "/")
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return "", name
+	}
+	return name[:i], name[i+1:]
+}
+
+// buildTree indexes the zips of fsys, returning the root of the
+// tree.
+func buildTree(fsys *FS) *treeNode {
+	root, _ := buildLayersTree(fsys, fsys.layers)
+	return root
+}
+
+// buildLayersTree indexes layers for fsys, also listing the entries
+// whose names were unsafe. For union mounts, the trees of the
+// separate zips are merged top down.
+func buildLayersTree(fsys *FS, layers []archiveLayer) (*treeNode, []UnsafeName) {
+	fsys.mut.Lock()
+	if fsys.dataOf == nil {
+		fsys.dataOf = make(map[*zip.File]io.ReaderAt)
+	}
+	var all []*layerFile
+	fileOf := make(map[*zip.File]*layerFile)
+	for _, l := range layers {
+		for _, f := range l.archive.File {
+			fsys.dataOf[f] = l.ra
+			if l.file != nil {
+				fileOf[f] = l.file
+			}
+		}
+		if l.file != nil {
+			all = append(all, l.file)
+		}
+	}
+	fsys.mut.Unlock()
+
+	var root *treeNode
+	var unsafe []UnsafeName
+	for _, l := range layers {
+		t, u := buildArchiveTree(fsys, l.archive)
+		unsafe = append(unsafe, u...)
+		if root == nil {
+			root = t
+		} else {
+			mergeTree(root, t)
+		}
+	}
+	if len(layers) > 1 {
+		dropWhiteouts(root)
+	}
+	sortTree(root)
+	root.modTime()
+	setNodeLayers(root, all, fileOf)
+	return root, unsafe
+}
+
+// setNodeLayers tells the nodes below n which layers they read from:
+// a file, its own; a directory, which may list entries of any of
+// them, all of the layers.
+func setNodeLayers(n *treeNode, all []*layerFile, fileOf map[*zip.File]*layerFile) {
+	for _, c := range n.order {
+		switch node := c.node.(type) {
+		case *Dir:
+			node.layers.files = all
+			setNodeLayers(c, all, fileOf)
+		case *File:
+			if lf := fileOf[c.file]; lf != nil {
+				node.layers.files = []*layerFile{lf}
+			}
+		}
+	}
+}
+
+// buildIndex builds the tree that the mount serves: the whole
+// archive, or just opts.Subdir of it.
+func (fsys *FS) buildIndex() error {
+	_, err := fsys.swapIndex(fsys.layers, fsys.footer)
+	return err
+}
+
+// swapIndex indexes layers and starts serving them, returning the
+// root of the tree served before. The layers it replaces are retired.
+func (fsys *FS) swapIndex(layers []archiveLayer, foot *Footer) (old *treeNode, err error) {
+	root, unsafe := buildLayersTree(fsys, layers)
+	if sub := fsys.subdir(); sub != "" {
+		for _, name := range strings.Split(sub, "/") {
+			c, ok := root.children[name]
+			if !ok || !c.isDir {
+				fsys.mut.Lock()
+				for _, l := range layers {
+					for _, f := range l.archive.File {
+						delete(fsys.dataOf, f)
+					}
+				}
+				fsys.mut.Unlock()
+				return nil, fmt.Errorf("subdir '%s' is not a directory in the zip", fsys.opts.Subdir)
+			}
+			root = c
+		}
+	}
+	entries, payloadBytes := treeStats(root)
+	var collisions []NameCollision
+	if fsys.opts.LookupFold != 0 {
+		collisions = foldTree(root, fsys.opts.LookupFold, "")
+		for _, c := range collisions {
+			VPrintf("buildTree: %s\n", c)
+		}
+	}
+
+	fsys.treeMut.Lock()
+	defer fsys.treeMut.Unlock()
+	if fsys.rootDir == nil {
+		fsys.rootDir = &Dir{fs: fsys, isRoot: true}
+	}
+	root.node = fsys.rootDir
+	old = fsys.root
+	fsys.retireLayers(fsys.layers, layers)
+	fsys.layers = layers
+	fsys.root = root
+	fsys.footer = foot
+	fsys.entries, fsys.payloadBytes = entries, payloadBytes
+	fsys.unsafe = unsafe
+	fsys.collisions = collisions
+	return old, nil
+}
+
+// subdir returns opts.Subdir as a clean zip path with no leading or
+// trailing slash; "" for the whole archive.
+func (fsys *FS) subdir() string {
+	return strings.Trim(path.Clean("/"+fsys.opts.Subdir), "/")
+}
+
+// mountPath turns the name of an entry in the mount into its path
+// below the mount root.
+func (fsys *FS) mountPath(name string) string {
+	sub := fsys.subdir()
+	if sub == "" {
+		return name
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(name, sub), "/")
+}
+
+// sortTree puts the children of every directory in name order.
+func sortTree(n *treeNode) {
+	sort.Slice(n.order, func(i, j int) bool {
+		return n.order[i].name < n.order[j].name
+	})
+	for _, c := range n.order {
+		if c.isDir {
+			sortTree(c)
+		}
+	}
+}
+
+// namedEntry is a zip entry with the path we serve it at.
+type namedEntry struct {
+	f    *zip.File
+	name string
+}
+
+// buildArchiveTree indexes one zip. Many zips (`zip -D`, jar tools)
+// leave out the entries for directories; we make up any that are
+// missing. Names are cleaned up by CleanEntryName, and those it
+// can't make safe are left out, or moved to opts.QuarantineDir,
+// which Start() has checked and cleaned up.
+func buildArchiveTree(fsys *FS, archive *zip.Reader) (*treeNode, []UnsafeName) {
+	root := newDirNode(fsys, "", nil)
+	quarantine := fsys.opts.QuarantineDir
+
+	var dirs, files []namedEntry
+	var unsafe []UnsafeName
+	for _, f := range archive.File {
+		name, err := CleanEntryName(f.Name)
+		if err != nil {
+			VPrintf("buildTree: unsafe entry name %q: %s\n", f.Name, err)
+			unsafe = append(unsafe, UnsafeName{Name: f.Name, Reason: err.Error()})
+			if quarantine == "" {
+				continue
+			}
+			name = quarantine + "/" + quarantineName(f.Name)
+			if strings.HasSuffix(f.Name, "/") {
+				name += "/"
+			}
+		}
+		if strings.HasSuffix(name, "/") {
+			dirs = append(dirs, namedEntry{f, name})
+		} else {
+			files = append(files, namedEntry{f, name})
+		}
+	}
+	// parents before children, whatever order the zip lists them in.
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i].name, "/") < strings.Count(dirs[j].name, "/")
+	})
+
+	byPath := map[string]*treeNode{"": root}
+
+	// mkdirAll returns the directory node for path, making up
+	// any missing ones along the way.
+	var mkdirAll func(path string) *treeNode
+	mkdirAll = func(path string) *treeNode {
+		if d, ok := byPath[path]; ok {
+			return d
+		}
+		dir, base := splitEntryPath(path)
+		parent := mkdirAll(dir)
+		d := newDirNode(fsys, base, nil)
+		if c, taken := parent.children[base]; taken && !c.isDir {
+			// a file is in the way; d stays unreachable.
+			VPrintf("buildTree: file '%s' shadows the directory of later entries\n", c.file.Name)
+		}
+		parent.addChild(d)
+		byPath[path] = d
+		return d
+	}
+
+	for _, e := range append(dirs, files...) {
+		dir, base := splitEntryPath(e.name)
+		if base == "" {
+			continue
+		}
+		parent := mkdirAll(dir)
+		if strings.HasSuffix(e.name, "/") {
+			path := strings.TrimSuffix(e.name, "/")
+			if _, dup := byPath[path]; dup {
+				continue
+			}
+			n := newDirNode(fsys, base, e.f)
+			byPath[path] = n
+			parent.addChild(n)
+		} else {
+			parent.addChild(&treeNode{name: base, file: e.f, node: &File{fs: fsys, file: e.f, path: e.name}})
+		}
+	}
+	return root, unsafe
+}
@@ -0,0 +1,260 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+// testArchive builds an in-memory zip holding the given entries (in
+// that order) and indexes it the way Start() does.
+func testArchive(names ...string) *FS {
+	fsys := &FS{layers: []archiveLayer{testLayer(names...)}}
+	fsys.root = buildTree(fsys)
+	return fsys
+}
+
+// testLayer builds an in-memory zip holding the given entries.
+func testLayer(names ...string) archiveLayer {
+	return zipLayerOf(testZipBytes(names...))
+}
+
+// testZipBytes makes a zip holding the given entries, each file
+// containing "contents of " and its name.
+func testZipBytes(names ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		panicOn(err)
+		if name[len(name)-1] != '/' {
+			w.Write([]byte("contents of " + name))
+		}
+	}
+	panicOn(zw.Close())
+	return buf.Bytes()
+}
+
+// writeTestZip writes the zip testZipBytes makes to path.
+func writeTestZip(path string, names ...string) {
+	panicOn(ioutil.WriteFile(path, testZipBytes(names...), 0644))
+}
+
+// zipLayerOf reads the zip in zipBytes as a layer.
+func zipLayerOf(zipBytes []byte) archiveLayer {
+	ra := bytes.NewReader(zipBytes)
+	archive, err := zip.NewReader(ra, int64(len(zipBytes)))
+	panicOn(err)
+	return archiveLayer{archive: archive, ra: ra}
+}
+
+// testFS indexes the zip in zipBytes the way Start() does, to serve
+// it as opts say.
+func testFS(zipBytes []byte, opts MountOptions) *FS {
+	fsys := &FS{layers: []archiveLayer{zipLayerOf(zipBytes)}, opts: opts}
+	fsys.root = buildTree(fsys)
+	return fsys
+}
+
+func lookupPath(fsys *FS, names ...string) (interface{}, error) {
+	var node interface{} = fsys.root.node
+	for _, name := range names {
+		d, ok := node.(*Dir)
+		if !ok {
+			return nil, fuse.ENOENT
+		}
+		var err error
+		node, err = d.Lookup(context.Background(), &fuse.LookupRequest{Name: name}, &fuse.LookupResponse{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func Test008TreeIndexAnswersLookupAndReadDirAll(t *testing.T) {
+
+	cv.Convey("the tree index should find entries no matter what order the zip lists them in, and hand back the same node each time", t, func() {
+		fsys := testArchive("dirA/dirB/hello", "dirA/dirB/", "top", "dirA/")
+
+		hello, err := lookupPath(fsys, "dirA", "dirB", "hello")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(hello.(*File).file.Name, cv.ShouldEqual, "dirA/dirB/hello")
+
+		again, err := lookupPath(fsys, "dirA", "dirB", "hello")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(again, cv.ShouldEqual, hello)
+
+		_, err = lookupPath(fsys, "dirA", "nope")
+		cv.So(err, cv.ShouldEqual, fuse.ENOENT)
+
+		ents, err := fsys.root.node.(*Dir).ReadDirAll(context.Background())
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ents, cv.ShouldResemble, []fuse.Dirent{
+			{Name: "dirA", Type: fuse.DT_Dir},
+			{Name: "top", Type: fuse.DT_File},
+		})
+	})
+}
+
+func Test009ImplicitDirectoriesAreSynthesized(t *testing.T) {
+
+	cv.Convey("a zip without directory entries should still mount with its full tree, the made-up directories carrying mode 0755 and their newest child's mtime", t, func() {
+		fsys := testArchive("dirA/dirB/hello", "dirA/other", "top")
+
+		hello, err := lookupPath(fsys, "dirA", "dirB", "hello")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(hello.(*File).file.Name, cv.ShouldEqual, "dirA/dirB/hello")
+
+		dirA, err := lookupPath(fsys, "dirA")
+		cv.So(err, cv.ShouldBeNil)
+		var a fuse.Attr
+		cv.So(dirA.(*Dir).Attr(context.Background(), &a), cv.ShouldBeNil)
+		cv.So(a.Mode, cv.ShouldEqual, implicitDirMode)
+		cv.So(a.Mtime.Equal(hello.(*File).file.ModTime()), cv.ShouldBeTrue)
+
+		ents, err := dirA.(*Dir).ReadDirAll(context.Background())
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ents, cv.ShouldResemble, []fuse.Dirent{
+			{Name: "dirB", Type: fuse.DT_Dir},
+			{Name: "other", Type: fuse.DT_File},
+		})
+	})
+}
+
+func Test012StatfsReportsArchiveTotals(t *testing.T) {
+
+	cv.Convey("Statfs should report the entry count as inodes and the uncompressed payload as blocks", t, func() {
+		fsys := testArchive("dirA/hello", "top")
+		fsys.entries, fsys.payloadBytes = treeStats(fsys.root)
+
+		var resp fuse.StatfsResponse
+		cv.So(fsys.Statfs(context.Background(), &fuse.StatfsRequest{}, &resp), cv.ShouldBeNil)
+		cv.So(resp.Files, cv.ShouldEqual, 4) // root, dirA, hello, top
+		cv.So(fsys.payloadBytes, cv.ShouldEqual, len("contents of dirA/hello")+len("contents of top"))
+		cv.So(resp.Blocks, cv.ShouldEqual, 1)
+		cv.So(resp.Bfree, cv.ShouldEqual, 0)
+		cv.So(resp.Namelen, cv.ShouldEqual, 255)
+
+		// a writable mount has the overlay directory's free space.
+		dir, err := ioutil.TempDir("", "libzipfs-overlay-test")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		fsys.overlay = newOverlay(fsys, dir)
+		resp = fuse.StatfsResponse{}
+		cv.So(fsys.Statfs(context.Background(), &fuse.StatfsRequest{}, &resp), cv.ShouldBeNil)
+		cv.So(resp.Bavail, cv.ShouldBeGreaterThan, 0)
+		cv.So(resp.Bfree, cv.ShouldBeGreaterThanOrEqualTo, resp.Bavail)
+		cv.So(resp.Blocks, cv.ShouldEqual, 1+resp.Bfree)
+		cv.So(resp.Files, cv.ShouldEqual, 4+resp.Ffree)
+	})
+}
+
+func Test031MountOptionsAdjustOwnersAndModes(t *testing.T) {
+
+	cv.Convey("applyAttr should set the owner, replace then mask the permissions of files and dirs separately, and strip setuid and setgid when asked", t, func() {
+		attr := func(o MountOptions, mode os.FileMode) fuse.Attr {
+			a := fuse.Attr{Mode: mode, Uid: 501, Gid: 20}
+			o.applyAttr(&a)
+			return a
+		}
+		file := os.FileMode(0644) | os.ModeSetuid
+		dir := os.ModeDir | 0755 | os.ModeSetgid
+		link := os.ModeSymlink | 0777
+
+		a := attr(MountOptions{}, file)
+		cv.So(a.Uid, cv.ShouldEqual, 0)
+		cv.So(a.Gid, cv.ShouldEqual, 0)
+		cv.So(a.Mode, cv.ShouldEqual, file)
+		cv.So(attr(MountOptions{}, dir).Mode, cv.ShouldEqual, dir)
+
+		a = attr(MountOptions{Uid: 1000, Gid: 100}, file)
+		cv.So(a.Uid, cv.ShouldEqual, 1000)
+		cv.So(a.Gid, cv.ShouldEqual, 100)
+
+		modes := MountOptions{FileMode: 0600, DirMode: 0700}
+		cv.So(attr(modes, file).Mode, cv.ShouldEqual, os.FileMode(0600)|os.ModeSetuid)
+		cv.So(attr(modes, dir).Mode, cv.ShouldEqual, os.ModeDir|0700|os.ModeSetgid)
+		cv.So(attr(modes, link).Mode, cv.ShouldEqual, link)
+
+		masks := MountOptions{FileMask: 0022, DirMask: 0077}
+		cv.So(attr(masks, os.FileMode(0666)).Mode, cv.ShouldEqual, os.FileMode(0644))
+		cv.So(attr(masks, os.ModeDir|0777).Mode, cv.ShouldEqual, os.ModeDir|0700)
+
+		// the mask applies after the replacement.
+		both := MountOptions{FileMode: 0666, FileMask: 0002, DirMode: 0777, DirMask: 0070}
+		cv.So(attr(both, file).Mode, cv.ShouldEqual, os.FileMode(0664)|os.ModeSetuid)
+		cv.So(attr(both, dir).Mode, cv.ShouldEqual, os.ModeDir|0707|os.ModeSetgid)
+
+		nosuid := MountOptions{StripSetuid: true}
+		cv.So(attr(nosuid, file).Mode, cv.ShouldEqual, os.FileMode(0644))
+		cv.So(attr(nosuid, dir).Mode, cv.ShouldEqual, os.ModeDir|0755)
+		cv.So(attr(nosuid, os.FileMode(0755)|os.ModeSetgid).Mode, cv.ShouldEqual, os.FileMode(0755))
+	})
+}
+
+func Test015SubdirMountsOnlyThatDirectory(t *testing.T) {
+
+	cv.Convey("with Subdir set, the mount root should be that directory of the zip, and nothing outside it reachable", t, func() {
+		fsys := testArchive("assets/img/logo.png", "assets/style.css", "secret.txt")
+		fsys.opts.Subdir = "/assets/"
+		cv.So(fsys.buildIndex(), cv.ShouldBeNil)
+
+		ents, err := fsys.root.node.(*Dir).ReadDirAll(context.Background())
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ents, cv.ShouldResemble, []fuse.Dirent{
+			{Name: "img", Type: fuse.DT_Dir},
+			{Name: "style.css", Type: fuse.DT_File},
+		})
+		logo, err := lookupPath(fsys, "img", "logo.png")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(fsys.mountPath(logo.(*File).path), cv.ShouldEqual, "img/logo.png")
+
+		_, err = lookupPath(fsys, "..", "secret.txt")
+		cv.So(err, cv.ShouldEqual, fuse.ENOENT)
+		cv.So(fsys.entries, cv.ShouldEqual, 4)
+
+		fsys.opts.Subdir = "style.css"
+		cv.So(fsys.buildIndex(), cv.ShouldNotBeNil)
+		fsys.opts.Subdir = "nope"
+		cv.So(fsys.buildIndex(), cv.ShouldNotBeNil)
+	})
+}
+
+func Test017CacheOptionsReachTheKernel(t *testing.T) {
+
+	cv.Convey("EntryValid, AttrValid and KeepCache should be passed on in Lookup, Attr and Open responses", t, func() {
+		ctx := context.Background()
+		fsys := testArchive("dirA/hello")
+		root := fsys.root.node.(*Dir)
+
+		resp := &fuse.LookupResponse{}
+		_, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "dirA"}, resp)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(resp.EntryValid, cv.ShouldEqual, 0)
+
+		fsys.opts = MountOptions{EntryValid: time.Hour, AttrValid: 2 * time.Hour, KeepCache: true}
+		_, err = root.Lookup(ctx, &fuse.LookupRequest{Name: "dirA"}, resp)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(resp.EntryValid, cv.ShouldEqual, time.Hour)
+
+		hello, err := lookupPath(fsys, "dirA", "hello")
+		cv.So(err, cv.ShouldBeNil)
+		var a fuse.Attr
+		cv.So(hello.(*File).Attr(ctx, &a), cv.ShouldBeNil)
+		cv.So(a.Valid, cv.ShouldEqual, 2*time.Hour)
+
+		oresp := &fuse.OpenResponse{}
+		h, err := hello.(*File).Open(ctx, &fuse.OpenRequest{}, oresp)
+		cv.So(err, cv.ShouldBeNil)
+		defer h.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{})
+		cv.So(oresp.Flags&fuse.OpenKeepCache, cv.ShouldNotEqual, 0)
+	})
+}
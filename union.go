@@ -0,0 +1,150 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ZipLayer locates one zip file of a union mount, the same way the
+// arguments to NewFuseZipFs do: the zip starts
+// ByteOffsetToZipFileStart bytes into ZipfilePath and runs for
+// BytesAvail bytes (0 => up to FooterBytes before the end of the
+// file). Set FooterBytes to the FooterLengthBytes of the footer of
+// combo files, and Payload to the name of the payload to serve, if
+// not the zip; ComboZipLayer does all that.
+type ZipLayer struct {
+	ZipfilePath              string
+	ByteOffsetToZipFileStart int64
+	BytesAvail               int64
+	FooterBytes              int64
+	Payload                  string
+}
+
+// isCombo reports whether l is the zip inside a combo file, and so
+// has a footer to read.
+func (l ZipLayer) isCombo() bool {
+	return l.FooterBytes >= LIBZIPFS_FOOTER_LEN
+}
+
+// NewUnionFuseZipFs mounts several zips as one tree at mountpoint,
+// layered in priority order: each path comes from the first zip in
+// layers that has it. Call Start() to start servicing fuse reads.
+//
+// Like the layers of a container image, a higher zip can delete
+// paths from the ones below it with whiteout entries: an entry
+// named ".wh.<name>" hides <name> in all lower zips, and an entry
+// ".wh..wh..opq" inside a directory hides everything the lower zips
+// have in that directory. Whiteout entries are themselves hidden.
+// (With a single zip, as from NewFuseZipFs, every entry is served
+// as-is.)
+func NewUnionFuseZipFs(layers []ZipLayer, mountpoint string) *FuseZipFs {
+
+	// must trim any trailing slash from the mountpoint, or else mount can fail
+	mountpoint = TrimTrailingSlashes(mountpoint)
+
+	p := &FuseZipFs{
+		MountPoint: mountpoint,
+		Ready:      make(chan bool),
+		ReqStop:    make(chan bool),
+		Done:       make(chan bool),
+		layers:     append([]ZipLayer(nil), layers...),
+	}
+	if len(layers) > 0 {
+		p.ZipfilePath = layers[0].ZipfilePath
+	}
+	return p
+}
+
+// archiveLayer is an opened ZipLayer: its zip directory, and the
+// bytes the zip was read from.
+type archiveLayer struct {
+	archive *zip.Reader
+	ra      io.ReaderAt
+	payload string     // see ZipLayer.Payload
+	file    *layerFile // nil for zips that aren't read from a file
+
+	// verified says we have checked the zip has the checksum
+	// the footer of its combo gives; see MountOptions.zipVerified.
+	verified bool
+}
+
+// layerFile is the file an archiveLayer reads from. Once a reload has
+// replaced the layer, it is closed as soon as no node the kernel holds
+// and no open handle refers to it; see FS.retireLayers.
+type layerFile struct {
+	fd      *os.File
+	files   []*zip.File // the entries of the zip, to forget on closing
+	refs    int
+	retired bool
+}
+
+// open reads the zip directory of l. The caller must close fd.
+func (l *ZipLayer) open() (fd *os.File, al archiveLayer, err error) {
+	bytesAvail := l.BytesAvail
+	if bytesAvail <= 0 {
+		statinfo, err := os.Stat(l.ZipfilePath)
+		if err != nil {
+			return nil, al, err
+		}
+		bytesAvail = statinfo.Size() - (l.ByteOffsetToZipFileStart + l.FooterBytes)
+		if bytesAvail <= 0 {
+			return nil, al, fmt.Errorf("FuseZipFs.Start() error: no bytes available to read from ZipfilePath '%s' (of size %d bytes) after subtracting offset %d", l.ZipfilePath, statinfo.Size(), l.ByteOffsetToZipFileStart)
+		}
+	}
+
+	fd, err = os.Open(l.ZipfilePath)
+	if err != nil {
+		return nil, al, err
+	}
+	rat := io.NewSectionReader(fd, l.ByteOffsetToZipFileStart, bytesAvail)
+	archive, err := zip.NewReader(rat, bytesAvail)
+	if err != nil {
+		fd.Close()
+		return nil, al, fmt.Errorf("FuseZipFs.Start() error: could not read zip '%s': '%s'", l.ZipfilePath, err)
+	}
+	registerDecompressors(archive)
+	lf := &layerFile{fd: fd, files: archive.File}
+	return fd, archiveLayer{archive: archive, ra: rat, payload: l.Payload, file: lf}, nil
+}
+
+// mergeTree adds what lower has to upper, where upper doesn't
+// already have it or white it out. The whiteouts themselves are
+// carried along too, so that they keep applying to any layers
+// merged in after lower.
+func mergeTree(upper, lower *treeNode) {
+	if _, opaque := upper.children[opaqueMarker]; opaque {
+		return
+	}
+	for _, c := range lower.order {
+		if _, gone := upper.children[whiteoutPrefix+c.name]; gone {
+			continue
+		}
+		u, taken := upper.children[c.name]
+		switch {
+		case !taken:
+			upper.addChild(c)
+		case u.isDir && c.isDir:
+			mergeTree(u, c)
+		}
+	}
+}
+
+// dropWhiteouts removes the whiteout entries below n, once all the
+// layers have been merged.
+func dropWhiteouts(n *treeNode) {
+	keep := n.order[:0]
+	for _, c := range n.order {
+		if strings.HasPrefix(c.name, whiteoutPrefix) {
+			delete(n.children, c.name)
+			continue
+		}
+		if c.isDir {
+			dropWhiteouts(c)
+		}
+		keep = append(keep, c)
+	}
+	n.order = keep
+}
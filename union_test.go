@@ -0,0 +1,53 @@
+package libzipfs
+
+import (
+	"testing"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+func Test014UnionOfZipsResolvesInPriorityOrder(t *testing.T) {
+
+	cv.Convey("a union mount should serve each path from the highest zip that has it, and honor whiteouts against lower zips", t, func() {
+		patch := testLayer("bin/app", "share/.wh.old.txt", "locale/.wh..wh..opq", "locale/fr.txt")
+		base := testLayer("bin/app", "bin/helper", "share/old.txt", "share/new.txt", "locale/en.txt", ".wh.not-a-whiteout-here")
+		fsys := &FS{layers: []archiveLayer{patch, base}}
+		fsys.root = buildTree(fsys)
+
+		names := func(dir ...string) []string {
+			node, err := lookupPath(fsys, dir...)
+			panicOn(err)
+			ents, err := node.(*Dir).ReadDirAll(context.Background())
+			panicOn(err)
+			var ns []string
+			for _, e := range ents {
+				ns = append(ns, e.Name)
+			}
+			return ns
+		}
+
+		app, err := lookupPath(fsys, "bin", "app")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(fsys.dataOf[app.(*File).file], cv.ShouldEqual, patch.ra)
+		helper, err := lookupPath(fsys, "bin", "helper")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(fsys.dataOf[helper.(*File).file], cv.ShouldEqual, base.ra)
+
+		cv.So(names("bin"), cv.ShouldResemble, []string{"app", "helper"})
+		cv.So(names("share"), cv.ShouldResemble, []string{"new.txt"})
+		_, err = lookupPath(fsys, "share", "old.txt")
+		cv.So(err, cv.ShouldEqual, fuse.ENOENT)
+		cv.So(names("locale"), cv.ShouldResemble, []string{"fr.txt"})
+		cv.So(names(), cv.ShouldResemble, []string{"bin", "locale", "share"})
+
+		entries, _ := treeStats(fsys.root)
+		cv.So(entries, cv.ShouldEqual, 8)
+
+		// a single zip serves its entries as they are.
+		single := testArchive("share/.wh.old.txt")
+		_, err = lookupPath(single, "share", ".wh.old.txt")
+		cv.So(err, cv.ShouldBeNil)
+	})
+}
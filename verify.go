@@ -0,0 +1,108 @@
+package libzipfs
+
+import (
+	"fmt"
+	"io"
+)
+
+// ChecksumError says which region of a combo file, or which file
+// split out of one, does not have the checksum its footer records.
+type ChecksumError struct {
+	Path      string
+	Region    string // "executable", "zipfile", or "payload 'name'"
+	Algorithm HashAlgorithm
+	Want      []byte
+	Got       []byte // nil if the region is shorter or longer than the footer says
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Got == nil {
+		return fmt.Sprintf("'%s': %s is not the length the footer gives, truncated?", e.Path, e.Region)
+	}
+	return fmt.Sprintf("'%s': %s %s checksum mismatch: the footer has '%x', but it hashes to '%x'", e.Path, e.Region, e.Algorithm, e.Want, e.Got)
+}
+
+// checkRegion makes sure the n bytes at off in ra, the region of path
+// called region, have the checksum want, by the HashAlgorithm of foot.
+func (foot *Footer) checkRegion(ra io.ReaderAt, path, region string, off, n int64, want [BLAKE2_HASH_LEN]byte) error {
+	alg := foot.HashAlgorithm
+	h := alg.New()
+	if h == nil {
+		return fmt.Errorf("'%s': unknown hash algorithm %s", path, alg)
+	}
+	cerr := &ChecksumError{Path: path, Region: region, Algorithm: alg, Want: want[:h.Size()]}
+	got, err := io.Copy(h, io.NewSectionReader(ra, off, n))
+	if err != nil {
+		return fmt.Errorf("could not read the %s of '%s': '%s'", region, path, err)
+	}
+	if got != n {
+		return cerr
+	}
+	sum := h.Sum(nil)
+	if padChecksum(sum) != want {
+		cerr.Got = sum
+		return cerr
+	}
+	return nil
+}
+
+// VerifyCombo hashes the executable, the zip and any payloads of the
+// combo file at path, returning a *ChecksumError for the first that
+// doesn't have the checksum its footer records.
+func VerifyCombo(path string) error {
+	_, foot, comb, err := ReadFooter(path)
+	if err != nil {
+		return err
+	}
+	defer comb.Close()
+
+	err = foot.checkRegion(comb, path, "executable", 0, foot.ExecutableLengthBytes, foot.ExecutableBlake2Checksum)
+	if err != nil {
+		return err
+	}
+	err = foot.checkRegion(comb, path, "zipfile", foot.ExecutableLengthBytes, foot.ZipfileLengthBytes, foot.ZipfileBlake2Checksum)
+	if err != nil {
+		return err
+	}
+	for _, pl := range foot.Payloads {
+		err = foot.checkRegion(comb, path, fmt.Sprintf("payload '%s'", pl.Name), pl.Offset, pl.Length, pl.Blake2Checksum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkZip makes sure al, the zip of the combo layer l, is just the
+// bytes foot gives the checksum of.
+func (foot *Footer) checkZip(l ZipLayer, al archiveLayer) error {
+	region, want, n := "zipfile", foot.ZipfileBlake2Checksum, foot.ZipfileLengthBytes
+	if pl, ok := foot.Payload(l.Payload); ok {
+		region, want, n = fmt.Sprintf("payload '%s'", pl.Name), pl.Blake2Checksum, pl.Length
+	}
+	sized, ok := al.ra.(interface {
+		Size() int64
+	})
+	if !ok || sized.Size() != n {
+		return &ChecksumError{Path: l.ZipfilePath, Region: region, Algorithm: foot.HashAlgorithm, Want: want[:foot.HashAlgorithm.Size()]}
+	}
+	return foot.checkRegion(al.ra, l.ZipfilePath, region, 0, n, want)
+}
+
+// checkChecksums makes sure the executable of the combo layer l, open
+// as fd, and its zip, open as al, have the checksums in its footer.
+// Plain zips have none to check.
+func checkChecksums(l ZipLayer, fd io.ReaderAt, al archiveLayer) error {
+	if !l.isCombo() {
+		return nil
+	}
+	_, foot, err := ComboZipLayer(l.ZipfilePath, l.Payload)
+	if err != nil {
+		return err
+	}
+	err = foot.checkRegion(fd, l.ZipfilePath, "executable", 0, foot.ExecutableLengthBytes, foot.ExecutableBlake2Checksum)
+	if err != nil {
+		return err
+	}
+	return foot.checkZip(l, al)
+}
@@ -0,0 +1,87 @@
+package libzipfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test028VerifyComboNamesTheBadRegion(t *testing.T) {
+
+	cv.Convey("VerifyCombo, and mounts with VerifyChecksums, should pass a sound combo, and name the exe, zip or payload that has been changed", t, func() {
+		dir, err := ioutil.TempDir("", "libzipfs.verify.")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+
+		writeTestZip(filepath.Join(dir, "web.zip"), "index.html")
+		combo := filepath.Join(dir, "combo")
+		cfg := CombinerConfig{
+			ExecutablePath: "testfiles/tester",
+			ZipfilePath:    "testfiles/hi.zip",
+			OutputPath:     combo,
+			Payloads:       []NamedPayload{{Name: "web-assets", Path: filepath.Join(dir, "web.zip")}},
+		}
+		panicOn(DoCombineExeAndZip(&cfg))
+		cv.So(VerifyCombo(combo), cv.ShouldBeNil)
+		cv.So(VerifyCombo("testfiles/expectedCombined"), cv.ShouldBeNil)
+
+		_, foot, comb, err := ReadFooter(combo)
+		panicOn(err)
+		comb.Close()
+		good, err := ioutil.ReadFile(combo)
+		panicOn(err)
+
+		// spoil writes a copy of the combo with the byte at off
+		// changed, and gives what VerifyCombo and the mount checks,
+		// of the zip and of the payload, say of it.
+		spoil := func(off int64) (verify, zip, payload error) {
+			by := append([]byte{}, good...)
+			by[off]++
+			path := filepath.Join(dir, "spoilt")
+			panicOn(ioutil.WriteFile(path, by, 0755))
+
+			mount := func(payload string) error {
+				l, _, err := ComboZipLayer(path, payload)
+				panicOn(err)
+				fd, al, err := l.open()
+				panicOn(err)
+				defer fd.Close()
+				return checkChecksums(l, fd, al)
+			}
+			return VerifyCombo(path), mount(""), mount("web-assets")
+		}
+		region := func(err error) string {
+			cerr, ok := err.(*ChecksumError)
+			if !ok {
+				return ""
+			}
+			return cerr.Region
+		}
+
+		verify, zip, payload := spoil(10)
+		cv.So(region(verify), cv.ShouldEqual, "executable")
+		cv.So(region(zip), cv.ShouldEqual, "executable")
+		cv.So(region(payload), cv.ShouldEqual, "executable")
+		cv.So(verify.Error(), cv.ShouldContainSubstring, "executable blake2b checksum mismatch")
+
+		verify, zip, payload = spoil(foot.ExecutableLengthBytes + 31)
+		cv.So(region(verify), cv.ShouldEqual, "zipfile")
+		cv.So(region(zip), cv.ShouldEqual, "zipfile")
+		cv.So(payload, cv.ShouldBeNil)
+
+		verify, zip, payload = spoil(foot.Payloads[0].Offset + 31)
+		cv.So(region(verify), cv.ShouldEqual, "payload 'web-assets'")
+		cv.So(zip, cv.ShouldBeNil)
+		cv.So(region(payload), cv.ShouldEqual, "payload 'web-assets'")
+
+		// plain zips have no checksums to check.
+		l := ZipLayer{ZipfilePath: "testfiles/hi.zip"}
+		fd, al, err := l.open()
+		panicOn(err)
+		defer fd.Close()
+		cv.So(checkChecksums(l, fd, al), cv.ShouldBeNil)
+	})
+}
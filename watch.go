@@ -0,0 +1,398 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// DefaultWatchInterval is how often a Watch mount looks at its zip
+// files when MountOptions.WatchInterval is zero.
+const DefaultWatchInterval = time.Second
+
+// fileStamp is what we compare to notice that a zip was rewritten.
+type fileStamp struct {
+	size  int64
+	mtime time.Time
+}
+
+func stampLayers(layers []ZipLayer) []fileStamp {
+	stamps := make([]fileStamp, len(layers))
+	for i, l := range layers {
+		if fi, err := os.Stat(l.ZipfilePath); err == nil {
+			stamps[i] = fileStamp{size: fi.Size(), mtime: fi.ModTime()}
+		}
+	}
+	return stamps
+}
+
+func sameStamps(a, b []fileStamp) bool {
+	for i := range a {
+		if a[i].size != b[i].size || !a[i].mtime.Equal(b[i].mtime) {
+			return false
+		}
+	}
+	return true
+}
+
+// watch polls the zip files until the mount is stopped, reloading
+// them once a change has settled: that is, once the size and mtime
+// have stayed the same for a whole interval, so that we don't read
+// a zip that is still being written.
+func (p *FuseZipFs) watch() {
+	interval := p.WatchInterval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	loaded := stampLayers(p.layers)
+	seen := loaded
+	for {
+		select {
+		case <-p.Done:
+			return
+		case <-tick.C:
+		}
+		now := stampLayers(p.layers)
+		switch {
+		case !sameStamps(now, seen):
+			seen = now // changing; wait for it to settle.
+		case !sameStamps(now, loaded):
+			loaded = now
+			if err := p.reload(); err != nil {
+				VPrintf("watch: keeping the old version of '%s': %s\n", p.ZipfilePath, err)
+			}
+		}
+	}
+}
+
+// locate re-reads the footer of a combo file, whose exe and zip may
+// have changed length.
+func (l ZipLayer) locate() (ZipLayer, *Footer, error) {
+	if !l.isCombo() {
+		return l, nil, nil
+	}
+	nl, foot, err := ComboZipLayer(l.ZipfilePath, l.Payload)
+	if err != nil {
+		return l, nil, err
+	}
+	return nl, foot, nil
+}
+
+// reload re-reads every zip and swaps in the new tree, then tells
+// the kernel to drop what it has cached about the paths that
+// changed. The old files stay open only as long as handles and
+// nodes still use them; see retireLayers.
+func (p *FuseZipFs) reload() error {
+	var fds []*os.File
+	closeAll := func() {
+		for _, fd := range fds {
+			fd.Close()
+		}
+	}
+
+	var layers []archiveLayer
+	var foot *Footer
+	for i, l := range p.layers {
+		l, f, err := l.locate()
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("could not read footer of '%s': '%s'", l.ZipfilePath, err)
+		}
+		if i == 0 {
+			foot = f
+		}
+		fd, al, err := l.open()
+		if err != nil {
+			closeAll()
+			return err
+		}
+		fds = append(fds, fd)
+		layers = append(layers, al)
+		if p.VerifyChecksums {
+			err = checkChecksums(l, fd, al)
+			if err != nil {
+				closeAll()
+				return fmt.Errorf("refusing to serve the new version of %s", err)
+			}
+		}
+		if p.RequireSignature {
+			err = checkSignature(l, al, p.trustedKeys())
+			if err != nil {
+				closeAll()
+				return fmt.Errorf("refusing to serve the new version of %s", err)
+			}
+		}
+		if i == 0 {
+			layers[0].verified = p.zipVerified(l, al)
+		}
+	}
+
+	p.mut.Lock()
+	if p.stopped {
+		p.mut.Unlock()
+		closeAll()
+		return nil
+	}
+	old, err := p.filesys.swapIndex(layers, foot)
+	if err != nil {
+		p.mut.Unlock()
+		closeAll()
+		return err
+	}
+	root, _ := p.filesys.current()
+	stale, n := p.invalidate("", old, root, nil)
+	p.mut.Unlock()
+
+	// the kernel may call back into us before an invalidation
+	// returns, so they must not be made holding p.mut.
+	for _, st := range stale {
+		if st.name != "" {
+			p.srv.InvalidateEntry(st.node, st.name)
+			continue
+		}
+		p.srv.InvalidateNodeAttr(st.node)
+		if !st.dir {
+			p.srv.InvalidateNodeData(st.node)
+		}
+	}
+	VPrintf("watch: reloaded '%s', %d paths changed\n", p.ZipfilePath, n)
+	return nil
+}
+
+// nodeLayers are the layers a Dir or File node reads from, which it
+// holds a reference to for as long as the kernel knows it.
+type nodeLayers struct {
+	files []*layerFile
+	held  bool
+}
+
+// holdNode is called as node is handed to the kernel, which keeps
+// it until it calls Forget; bazil.org/fuse makes one call, however
+// many times the node was looked up.
+func (fsys *FS) holdNode(node fs.Node) {
+	var nl *nodeLayers
+	switch n := node.(type) {
+	case *Dir:
+		nl = &n.layers
+	case *File:
+		nl = &n.layers
+	default:
+		return
+	}
+	fsys.mut.Lock()
+	defer fsys.mut.Unlock()
+	if !nl.held {
+		nl.held = true
+		for _, lf := range nl.files {
+			lf.refs++
+		}
+	}
+}
+
+// forgetNode is called once the kernel has forgotten a node.
+func (fsys *FS) forgetNode(nl *nodeLayers) {
+	fsys.mut.Lock()
+	defer fsys.mut.Unlock()
+	if nl.held {
+		nl.held = false
+		fsys.unref(nl.files)
+	}
+}
+
+// holdLayers keeps layers open for a file handle, until dropLayers.
+func (fsys *FS) holdLayers(layers []*layerFile) {
+	fsys.mut.Lock()
+	defer fsys.mut.Unlock()
+	for _, lf := range layers {
+		lf.refs++
+	}
+}
+
+func (fsys *FS) dropLayers(layers []*layerFile) {
+	fsys.mut.Lock()
+	defer fsys.mut.Unlock()
+	fsys.unref(layers)
+}
+
+// unref drops a reference to each of layers, closing those that are
+// retired and now unused. fsys.mut must be held.
+func (fsys *FS) unref(layers []*layerFile) {
+	for _, lf := range layers {
+		lf.refs--
+		if lf.refs == 0 && lf.retired {
+			fsys.closeLayer(lf)
+		}
+	}
+}
+
+// retireLayers is told of the layers old that a reload has replaced
+// with now. Their cached contents are dropped straight away, and each
+// is closed once nothing refers to it any more.
+func (fsys *FS) retireLayers(old, now []archiveLayer) {
+	fsys.mut.Lock()
+	defer fsys.mut.Unlock()
+	kept := make(map[*layerFile]bool)
+	for _, l := range now {
+		kept[l.file] = true
+	}
+	for _, l := range old {
+		lf := l.file
+		if lf == nil || kept[lf] || lf.retired {
+			continue
+		}
+		lf.retired = true
+		if fsys.cache != nil {
+			fsys.cache.drop(lf.files)
+		}
+		if lf.refs == 0 {
+			fsys.closeLayer(lf)
+		} else {
+			if fsys.retired == nil {
+				fsys.retired = make(map[*layerFile]bool)
+			}
+			fsys.retired[lf] = true
+		}
+	}
+}
+
+// closeLayer closes lf, and forgets what we kept about its entries.
+// fsys.mut must be held.
+func (fsys *FS) closeLayer(lf *layerFile) {
+	VPrintf("closing retired zip '%s'\n", lf.fd.Name())
+	lf.fd.Close()
+	for _, f := range lf.files {
+		delete(fsys.dataOf, f)
+		delete(fsys.indexes, f)
+	}
+	if fsys.cache != nil {
+		fsys.cache.drop(lf.files)
+	}
+	delete(fsys.retired, lf)
+}
+
+// closeLayers closes the files of every layer, current or retired,
+// for Stop().
+func (fsys *FS) closeLayers() {
+	fsys.treeMut.RLock()
+	layers := fsys.layers
+	fsys.treeMut.RUnlock()
+	fsys.mut.Lock()
+	defer fsys.mut.Unlock()
+	for _, l := range layers {
+		if l.file != nil {
+			l.file.fd.Close()
+		}
+	}
+	for lf := range fsys.retired {
+		lf.fd.Close()
+	}
+}
+
+// kernelNode returns the node we have handed the kernel for path,
+// which held oc before the reload; nil if there is none.
+func (p *FuseZipFs) kernelNode(path string, oc *treeNode) fs.Node {
+	if ov := p.filesys.overlay; ov != nil {
+		ov.mut.Lock()
+		defer ov.mut.Unlock()
+		return ov.nodes[path]
+	}
+	if path == "" {
+		return p.filesys.rootDir
+	}
+	if oc == nil {
+		return nil
+	}
+	return oc.node
+}
+
+// staleNode is a node we have handed the kernel, or the entry name
+// in it if name is set, that the kernel must forget after a reload.
+type staleNode struct {
+	node fs.Node
+	name string
+	dir  bool
+}
+
+// invalidate finds what the kernel must forget in the directory at
+// path, which held old and now holds new: the entries for names
+// whose entry or anything below it changed, and the nodes behind
+// them. It appends those to stale, and returns it with how many
+// names it found.
+func (p *FuseZipFs) invalidate(path string, old, new *treeNode, stale []staleNode) ([]staleNode, int) {
+	dir := p.kernelNode(path, old)
+	if dir == nil {
+		return stale, 0
+	}
+	stale = append(stale, staleNode{node: dir, dir: true})
+
+	changed := 0
+	forget := func(name string, oc *treeNode) {
+		changed++
+		stale = append(stale, staleNode{node: dir, name: name})
+		if n := p.kernelNode(joinPath(path, name), oc); n != nil {
+			stale = append(stale, staleNode{node: n})
+		}
+	}
+	for _, oc := range old.order {
+		nc, ok := new.children[oc.name]
+		switch {
+		case !ok || oc.isDir != nc.isDir || !sameEntry(oc.file, nc.file):
+			forget(oc.name, oc)
+		case oc.isDir && treeDiffers(oc, nc):
+			if p.filesys.overlay != nil {
+				// overlay nodes go by path, so the kernel's nodes
+				// below here now serve the new tree; they just
+				// need to forget what they cached.
+				var n int
+				stale, n = p.invalidate(joinPath(path, oc.name), oc, nc, stale)
+				changed += n
+			} else {
+				// the kernel must look the directory up again, to
+				// get a Dir serving the new tree.
+				forget(oc.name, oc)
+			}
+		}
+	}
+	for _, nc := range new.order {
+		if _, ok := old.children[nc.name]; !ok {
+			forget(nc.name, nil)
+		}
+	}
+	return stale, changed
+}
+
+// treeDiffers reports whether anything below directories a and b
+// differs.
+func treeDiffers(a, b *treeNode) bool {
+	if len(a.order) != len(b.order) {
+		return true
+	}
+	for _, ac := range a.order {
+		bc, ok := b.children[ac.name]
+		if !ok || ac.isDir != bc.isDir || !sameEntry(ac.file, bc.file) {
+			return true
+		}
+		if ac.isDir && treeDiffers(ac, bc) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameEntry reports whether two zip entries (nil for made-up
+// directories) would read and stat the same.
+func sameEntry(a, b *zip.File) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.CRC32 == b.CRC32 &&
+		a.UncompressedSize64 == b.UncompressedSize64 &&
+		a.Mode() == b.Mode() &&
+		a.ModTime().Equal(b.ModTime())
+}
@@ -0,0 +1,146 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+func Test016ReloadSwapsTheTreeUnderTheRoot(t *testing.T) {
+
+	cv.Convey("after a reload the mount root should serve the new zip, while nodes looked up before keep serving the old one", t, func() {
+		fsys := &FS{layers: []archiveLayer{testLayer("docs/a.txt", "docs/b.txt", "same/x")}}
+		cv.So(fsys.buildIndex(), cv.ShouldBeNil)
+		rootNode, err := fsys.Root()
+		cv.So(err, cv.ShouldBeNil)
+		root := rootNode.(*Dir)
+		ctx := context.Background()
+
+		oldDocs, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "docs"}, &fuse.LookupResponse{})
+		cv.So(err, cv.ShouldBeNil)
+
+		old, err := fsys.swapIndex([]archiveLayer{testLayer("docs/a.txt", "same/x", "new.txt")}, nil)
+		cv.So(err, cv.ShouldBeNil)
+		again, err := fsys.Root()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(again, cv.ShouldEqual, rootNode)
+
+		ents, err := root.ReadDirAll(ctx)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(ents, cv.ShouldResemble, []fuse.Dirent{
+			{Name: "docs", Type: fuse.DT_Dir},
+			{Name: "new.txt", Type: fuse.DT_File},
+			{Name: "same", Type: fuse.DT_Dir},
+		})
+
+		newDocs, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "docs"}, &fuse.LookupResponse{})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(newDocs, cv.ShouldNotEqual, oldDocs)
+		ents, err = oldDocs.(*Dir).ReadDirAll(ctx)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(ents), cv.ShouldEqual, 2)
+
+		cur, _ := fsys.current()
+		cv.So(treeDiffers(old.children["docs"], cur.children["docs"]), cv.ShouldBeTrue)
+		cv.So(treeDiffers(old.children["same"], cur.children["same"]), cv.ShouldBeFalse)
+	})
+}
+
+func Test033ReloadClosesOldZipsOnceNothingUsesThem(t *testing.T) {
+
+	cv.Convey("a reload should close the zip it replaced, and forget its entries, once the nodes and handles still using it are gone", t, func() {
+		dir, err := ioutil.TempDir("", "libzipfs.reload.")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "docs.zip")
+		writeTestZip(path, "docs/a.txt", "docs/b.txt")
+
+		p := NewFuseZipFs(path, dir, 0, 0, 0)
+		p.CacheBytes = 1 << 20
+		p.srv = fs.New(nil, nil) // the kernel has no nodes to invalidate
+		fd, al, err := p.layers[0].open()
+		panicOn(err)
+		p.filesys = &FS{layers: []archiveLayer{al}, opts: p.MountOptions}
+		panicOn(p.filesys.buildIndex())
+		fsys := p.filesys
+		ctx := context.Background()
+
+		// closed reports whether the file of a layer has been closed.
+		closed := func(lf *layerFile) bool {
+			_, err := lf.fd.Stat()
+			return err != nil
+		}
+		known := func(f *zip.File) bool {
+			fsys.mut.Lock()
+			defer fsys.mut.Unlock()
+			_, data := fsys.dataOf[f]
+			_, index := fsys.indexes[f]
+			return data || index
+		}
+
+		root, err := fsys.Root()
+		panicOn(err)
+		docs, err := root.(*Dir).Lookup(ctx, &fuse.LookupRequest{Name: "docs"}, &fuse.LookupResponse{})
+		panicOn(err)
+		a, err := docs.(*Dir).Lookup(ctx, &fuse.LookupRequest{Name: "a.txt"}, &fuse.LookupResponse{})
+		panicOn(err)
+		h, err := a.(*File).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+		panicOn(err)
+		oldA := a.(*File).file
+		_, err = fsys.seekIndexFor(ctx, oldA)
+		panicOn(err)
+		_, cached := fsys.cache.entries[oldA]
+		cv.So(cached, cv.ShouldBeTrue)
+
+		// the first reload's zip is closed at once, as nothing uses it;
+		// the original stays open for docs, a.txt and its handle.
+		writeTestZip(path, "docs/a.txt", "new.txt")
+		cv.So(p.reload(), cv.ShouldBeNil)
+		first := fsys.layers[0].file
+		before, _ := fsys.current()
+		writeTestZip(path, "docs/a.txt", "newer.txt")
+		cv.So(p.reload(), cv.ShouldBeNil)
+
+		// what the reload had the kernel forget, once p.mut was free.
+		after, _ := fsys.current()
+		stale, n := p.invalidate("", before, after, nil)
+		cv.So(n, cv.ShouldEqual, 2)
+		newTxt := before.children["new.txt"].node
+		cv.So(stale, cv.ShouldResemble, []staleNode{
+			{node: fsys.rootDir, dir: true},
+			{node: fsys.rootDir, name: "new.txt"},
+			{node: newTxt},
+			{node: fsys.rootDir, name: "newer.txt"},
+		})
+		cv.So(closed(first), cv.ShouldBeTrue)
+		cv.So(known(first.files[0]), cv.ShouldBeFalse)
+
+		cv.So(closed(al.file), cv.ShouldBeFalse)
+		cv.So(known(oldA), cv.ShouldBeTrue)
+		_, cached = fsys.cache.entries[oldA]
+		cv.So(cached, cv.ShouldBeFalse)
+		cv.So(fsys.retired[al.file], cv.ShouldBeTrue)
+
+		panicOn(h.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{}))
+		a.(*File).Forget()
+		cv.So(closed(al.file), cv.ShouldBeFalse)
+		docs.(*Dir).Forget()
+		cv.So(closed(al.file), cv.ShouldBeTrue)
+		cv.So(known(oldA), cv.ShouldBeFalse)
+		cv.So(len(fsys.retired), cv.ShouldEqual, 0)
+		cv.So(fd.Close(), cv.ShouldNotBeNil)
+
+		// the zip now served stays open until Stop().
+		now := fsys.layers[0].file
+		cv.So(closed(now), cv.ShouldBeFalse)
+		fsys.closeLayers()
+		cv.So(closed(now), cv.ShouldBeTrue)
+	})
+}
@@ -0,0 +1,144 @@
+package libzipfs
+
+import (
+	"archive/zip"
+	"fmt"
+	"strconv"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// Extended attributes let you see how an entry is stored in the zip
+// without splitting the combo apart, e.g.
+//
+//	$ getfattr -d mnt/dirA/dirB/hello
+//	user.libzipfs.method="deflate"
+//	user.libzipfs.crc32="e80c4e41"
+//	...
+//
+// The root directory of a combo mount also carries the checksums
+// from its footer, and the hash algorithm that made them.
+
+const xattrPrefix = "user.libzipfs."
+
+type xattr struct {
+	name  string
+	value string
+}
+
+func zipMethodName(m uint16) string {
+	switch m {
+	case zip.Store:
+		return "store"
+	case zip.Deflate:
+		return "deflate"
+	case methodBzip2:
+		return "bzip2"
+	case methodZstd:
+		return "zstd"
+	case methodXz:
+		return "xz"
+	case winzipAESMethod:
+		return "winzip-aes"
+	}
+	return fmt.Sprintf("method-%d", m)
+}
+
+func zipXattrs(f *zip.File) []xattr {
+	xs := []xattr{
+		{"name", f.Name},
+		{"method", zipMethodName(f.Method)},
+		{"crc32", fmt.Sprintf("%08x", f.CRC32)},
+		{"compressed_size", strconv.FormatUint(f.CompressedSize64, 10)},
+		{"uncompressed_size", strconv.FormatUint(f.UncompressedSize64, 10)},
+		{"modified", f.ModTime().Format(time.RFC3339)},
+	}
+	if f.Comment != "" {
+		xs = append(xs, xattr{"comment", f.Comment})
+	}
+	return xs
+}
+
+// footerXattrs gives the checksums of foot, by hash_algorithm, with
+// the zip's those of payload, if that is what the mount serves.
+// BLAKE2b footers also give them under the *_blake2 names they had
+// before there was a choice of hash.
+func footerXattrs(foot *Footer, payload string) []xattr {
+	n := foot.HashAlgorithm.Size()
+	sums := []xattr{{"exe", fmt.Sprintf("%x", foot.ExecutableBlake2Checksum[:n])}}
+	if sum, ok := foot.zipChecksum(payload); ok {
+		sums = append(sums, xattr{"zip", fmt.Sprintf("%x", sum[:n])})
+	}
+	sums = append(sums, xattr{"footer", fmt.Sprintf("%x", foot.FooterBlake2Checksum[:n])})
+
+	xs := []xattr{{"hash_algorithm", foot.HashAlgorithm.String()}}
+	for _, s := range sums {
+		xs = append(xs, xattr{s.name + "_sum", s.value})
+	}
+	if foot.HashAlgorithm == HashBLAKE2b {
+		for _, s := range sums {
+			xs = append(xs, xattr{s.name + "_blake2", s.value})
+		}
+	}
+	return xs
+}
+
+func getxattr(xs []xattr, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	for _, x := range xs {
+		if xattrPrefix+x.name == req.Name {
+			resp.Xattr = []byte(x.value)
+			return nil
+		}
+	}
+	return fuse.ErrNoXattr
+}
+
+func listxattr(xs []xattr, resp *fuse.ListxattrResponse) {
+	for _, x := range xs {
+		resp.Append(xattrPrefix + x.name)
+	}
+}
+
+func (d *Dir) xattrs() []xattr {
+	var xs []xattr
+	n := d.tree()
+	if n.file != nil {
+		xs = zipXattrs(n.file)
+	}
+	if root, foot := d.fs.current(); n == root && foot != nil {
+		d.fs.treeMut.RLock()
+		payload := d.fs.layers[0].payload
+		d.fs.treeMut.RUnlock()
+		xs = append(xs, footerXattrs(foot, payload)...)
+	}
+	return xs
+}
+
+var _ = fs.NodeGetxattrer(&Dir{})
+
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(d.xattrs(), req, resp)
+}
+
+var _ = fs.NodeListxattrer(&Dir{})
+
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	listxattr(d.xattrs(), resp)
+	return nil
+}
+
+var _ = fs.NodeGetxattrer(&File{})
+
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(zipXattrs(f.file), req, resp)
+}
+
+var _ = fs.NodeListxattrer(&File{})
+
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	listxattr(zipXattrs(f.file), resp)
+	return nil
+}
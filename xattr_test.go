@@ -0,0 +1,66 @@
+package libzipfs
+
+import (
+	"testing"
+
+	"bazil.org/fuse"
+	cv "github.com/glycerine/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+func Test011XattrsExposeZipMetadata(t *testing.T) {
+
+	cv.Convey("files should list and return their zip header fields as user.libzipfs.* xattrs, and the root of a combo its footer checksums", t, func() {
+		fsys := testArchive("dirA/hello")
+		fsys.footer = &Footer{}
+		fsys.footer.ZipfileBlake2Checksum[0] = 0xab
+
+		node, err := lookupPath(fsys, "dirA", "hello")
+		panicOn(err)
+		hello := node.(*File)
+
+		var list fuse.ListxattrResponse
+		cv.So(hello.Listxattr(context.Background(), &fuse.ListxattrRequest{}, &list), cv.ShouldBeNil)
+		cv.So(string(list.Xattr), cv.ShouldContainSubstring, "user.libzipfs.crc32\x00")
+
+		var get fuse.GetxattrResponse
+		err = hello.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.libzipfs.method"}, &get)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(get.Xattr), cv.ShouldEqual, "deflate")
+
+		err = hello.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.libzipfs.nope"}, &get)
+		cv.So(err, cv.ShouldEqual, fuse.ErrNoXattr)
+
+		root := fsys.root.node.(*Dir)
+		err = root.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.libzipfs.zip_blake2"}, &get)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(get.Xattr[:4]), cv.ShouldEqual, "ab00")
+
+		// a mount of a named payload gives the payload's checksum.
+		web := Payload{Name: "web-assets"}
+		web.Blake2Checksum[0] = 0xcd
+		fsys.footer.Payloads = []Payload{web}
+		fsys.layers[0].payload = "web-assets"
+		err = root.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.libzipfs.zip_sum"}, &get)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(get.Xattr[:4]), cv.ShouldEqual, "cd00")
+		cv.So(len(get.Xattr), cv.ShouldEqual, 128)
+		err = root.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.libzipfs.zip_blake2"}, &get)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(get.Xattr[:4]), cv.ShouldEqual, "cd00")
+
+		// checksums are as long as their hash algorithm makes them.
+		fsys.footer.HashAlgorithm = HashSHA256
+		err = root.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.libzipfs.hash_algorithm"}, &get)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(get.Xattr), cv.ShouldEqual, "sha256")
+		for _, name := range []string{"exe", "zip", "footer"} {
+			err = root.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.libzipfs." + name + "_sum"}, &get)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(len(get.Xattr), cv.ShouldEqual, 64)
+			// the blake2 names would be wrong for it.
+			err = root.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.libzipfs." + name + "_blake2"}, &get)
+			cv.So(err, cv.ShouldEqual, fuse.ErrNoXattr)
+		}
+	})
+}